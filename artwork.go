@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+)
+
+// backgroundImage matches the url of a css background image
+var backgroundImage = regexp.MustCompile(`background(?:-image)?\s*:[^;]*url\(\s*['"]?([^'")]+)['"]?\s*\)`)
+
+// episodeImage is the thumbnail of an episode on the show page, given as
+// the data-podimage attribute of the episode link or as an img or a
+// background image of its .pod_img, empty when the episode has none
+func episodeImage(sel *goquery.Selection) string {
+	if img := strings.TrimSpace(sel.AttrOr("data-podimage", "")); img != "" {
+		return img
+	}
+	thumb := sel.Find(".pod_img").First()
+	if src := strings.TrimSpace(thumb.Find("img").First().AttrOr("src", "")); src != "" {
+		return src
+	}
+	if m := backgroundImage.FindStringSubmatch(thumb.AttrOr("style", "")); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
+// artworkTTL is how long the size of an image is cached before it is
+// loaded again
+const artworkTTL = 24 * time.Hour
+
+// artworkInfo is the size and format of an image, or why it could not be
+// loaded
+type artworkInfo struct {
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// problems lists why the image is not usable as artwork
+func (a artworkInfo) problems() []string {
+	if a.Error != "" {
+		return []string{a.Error}
+	}
+	return artworkProblems(image.Config{Width: a.Width, Height: a.Height}, a.Format)
+}
+
+// artworkCache remembers the size of the artwork loaded, and keeps it in
+// a json file between runs when it has one
+type artworkCache struct {
+	file string
+
+	mu     sync.Mutex
+	images map[string]artworkInfo
+	dirty  bool
+}
+
+// newArtworkCache loads the cached sizes from the file, an empty file
+// name keeps the cache in memory only
+func newArtworkCache(file string) *artworkCache {
+	c := &artworkCache{file: file, images: make(map[string]artworkInfo)}
+	if file == "" {
+		return c
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			rootLogger.Warn("Failed to read artwork cache", "file", file, "err", err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(buf, &c.images); err != nil {
+		rootLogger.Warn("Failed to parse artwork cache", "file", file, "err", err)
+		c.images = make(map[string]artworkInfo)
+	}
+	return c
+}
+
+// lookup returns the size of the image at the link, loading it unless it
+// was checked recently
+func (c *artworkCache) lookup(ctx context.Context, link string) artworkInfo {
+	c.mu.Lock()
+	info, ok := c.images[link]
+	c.mu.Unlock()
+	if ok && now().Sub(info.CheckedAt) < artworkTTL {
+		return info
+	}
+	cfg, format, err := fetchImageConfig(ctx, link)
+	info = artworkInfo{Width: cfg.Width, Height: cfg.Height, Format: format, CheckedAt: now()}
+	if err != nil {
+		info = artworkInfo{Error: err.Error(), CheckedAt: now()}
+		if ctx.Err() != nil {
+			// a cancelled request says nothing about the image
+			return info
+		}
+	}
+	c.mu.Lock()
+	c.images[link], c.dirty = info, true
+	c.mu.Unlock()
+	return info
+}
+
+// imageConfig is lookup in the shape of loadImageConfig
+func (c *artworkCache) imageConfig(ctx context.Context, link string) (image.Config, string, error) {
+	info := c.lookup(ctx, link)
+	if info.Error != "" {
+		return image.Config{}, "", errors.New(info.Error)
+	}
+	return image.Config{Width: info.Width, Height: info.Height}, info.Format, nil
+}
+
+// save writes the cache to its file when it changed
+func (c *artworkCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == "" || !c.dirty {
+		return nil
+	}
+	buf, err := json.MarshalIndent(c.images, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(c.file); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.file); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// verifyArtwork checks the channel and episode artwork against the Apple
+// Podcasts rules and logs every image which does not meet them
+func (c *artworkCache) verifyArtwork(ctx context.Context, channelImage URL, items []Item) {
+	logger := loggerFrom(ctx).With("component", "artwork")
+	if link := channelImage.String(); link != "" {
+		if problems := c.lookup(ctx, link).problems(); len(problems) > 0 {
+			logger.Warn("Podcast artwork does not meet the artwork rules", "url", link, "problems", strings.Join(problems, "; "))
+		}
+	}
+	for i := range items {
+		link := items[i].ItunesImage.URL.String()
+		if link == "" || link == channelImage.String() {
+			continue
+		}
+		if problems := c.lookup(ctx, link).problems(); len(problems) > 0 {
+			logger.Warn("Episode artwork does not meet the artwork rules", "item", items[i].Title, "url", link, "problems", strings.Join(problems, "; "))
+		}
+	}
+	if err := c.save(); err != nil {
+		logger.Warn("Failed to save artwork cache", "file", c.file, "err", err)
+	}
+}
+
+type artworkKey struct{}
+
+// withArtwork verifies the artwork scraped with the context against the
+// cache
+func withArtwork(ctx context.Context, c *artworkCache) context.Context {
+	return context.WithValue(ctx, artworkKey{}, c)
+}
+
+// artworkFrom returns the artwork cache of the context, nil when the
+// artwork is not verified
+func artworkFrom(ctx context.Context) *artworkCache {
+	c, _ := ctx.Value(artworkKey{}).(*artworkCache)
+	return c
+}
+
+// feedBuilder verifies the artwork of the feeds built by the builder
+func (c *artworkCache) feedBuilder(builder FeedBuilder) FeedBuilder {
+	return func(ctx context.Context, podcast Podcast, selfLink AtomLink) (RSS, error) {
+		return builder(withArtwork(ctx, c), podcast, selfLink)
+	}
+}
+
+// masterBuilder verifies the artwork of the items merged by the builder
+func (c *artworkCache) masterBuilder(master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		return master(withArtwork(ctx, c), podcasts, selfLink)
+	}
+}
+
+// configArtwork is the artwork cache of the config, nil unless the
+// artwork is verified
+func configArtwork(config Config) *artworkCache {
+	if !config.VerifyArtwork {
+		return nil
+	}
+	return newArtworkCache(config.ArtworkCache)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// episodesPage is a show page whose episodes have their own thumbnails
+const episodesPage = `<html><head>
+<link rel="canonical" href="https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153">
+</head><body><div class="podcast_list small_podcast">
+<div class="podcast_button"><a data-podname="Crime Diary EP 40 - Attribute - November 9, 2018" data-podcast="https://prc.listenon.in/odm/podcasts/ep40.mp3" data-podimage="/images/ep40.png" href="#">
+<div class="pod_img abc"></div></a></div>
+<div class="podcast_button"><a data-podname="Crime Diary EP 39 - Image - November 2, 2018" data-podcast="https://prc.listenon.in/odm/podcasts/ep39.mp3" href="#">
+<div class="pod_img abc"><img src="http://www.radiocity.in//images/ep 39.png"></div></a></div>
+<div class="podcast_button"><a data-podname="Crime Diary EP 38 - Background - October 29, 2018" data-podcast="https://prc.listenon.in/odm/podcasts/ep38.mp3" href="#">
+<div class="pod_img abc" style="color: red; background-image: url('../../../images/ep38.png')"></div></a></div>
+<div class="podcast_button"><a data-podname="Crime Diary EP 37 - None - October 12, 2018" data-podcast="https://prc.listenon.in/odm/podcasts/ep37.mp3" href="#">
+<div class="pod_img abc"></div></a></div>
+</div></body></html>`
+
+func TestEpisodeArtwork(t *testing.T) {
+	newFakeRadioCity(t)
+	podcast := Podcast{Path: "/cd", Image: "https://www.radiocity.in/images/cd.png", Categories: []string{"crime"}}
+	items, err := getItems(context.Background(), podcast, []byte(episodesPage), time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to extract items\n%q", err)
+	}
+	want := []string{
+		"https://www.radiocity.in/images/ep40.png",
+		"https://www.radiocity.in/images/ep%2039.png",
+		"https://www.radiocity.in/images/ep38.png",
+		"https://www.radiocity.in/images/cd.png",
+	}
+	if len(items) != len(want) {
+		t.Fatalf("Expected %d items but found %d", len(want), len(items))
+	}
+	for i, item := range items {
+		if got := item.ItunesImage.URL.String(); got != want[i] {
+			t.Errorf("Expected %q to have the artwork %s but had %s", item.Title, want[i], got)
+		}
+	}
+}
+
+func TestVerifyArtwork(t *testing.T) {
+	fake := newFakeRadioCity(t)
+	fake.set(func(f *fakeRadioCity) {
+		f.ArtworkSizes["www.radiocity.in/images/ep40.png"] = 500
+		f.Status["www.radiocity.in/images/ep38.png"] = http.StatusNotFound
+	})
+	file := filepath.Join(t.TempDir(), "artwork.json")
+	cache := newArtworkCache(file)
+	ctx := withArtwork(context.Background(), cache)
+	podcast := Podcast{Path: "/cd", Image: "https://www.radiocity.in/images/cd.png", Categories: []string{"crime"}}
+	items, err := getItems(ctx, podcast, []byte(episodesPage), time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to extract items\n%q", err)
+	}
+	want := []string{
+		"https://www.radiocity.in/images/ep40.png",
+		"https://www.radiocity.in/images/ep%2039.png",
+		"https://www.radiocity.in/images/ep38.png",
+		podcast.Image,
+	}
+	for i, item := range items {
+		if got := item.ItunesImage.URL.String(); got != want[i] {
+			t.Errorf("Expected %q to keep the artwork %s but had %s", item.Title, want[i], got)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Expected the artwork cache to be saved\n%q", err)
+	}
+	var saved map[string]artworkInfo
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		t.Fatalf("Failed to parse the artwork cache\n%q", err)
+	}
+	if info := saved["https://www.radiocity.in/images/ep40.png"]; info.Width != 500 || len(info.problems()) == 0 {
+		t.Errorf("Expected the small artwork to be cached with problems but was %+v", info)
+	}
+	if info := saved["https://www.radiocity.in/images/ep38.png"]; info.Error == "" {
+		t.Errorf("Expected the missing artwork to be cached with an error but was %+v", info)
+	}
+
+	loaded := len(fake.Requests())
+	ctx = withArtwork(context.Background(), newArtworkCache(file))
+	if _, err := getItems(ctx, podcast, []byte(episodesPage), time.Time{}); err != nil {
+		t.Fatalf("Failed to extract items\n%q", err)
+	}
+	for _, req := range fake.Requests()[loaded:] {
+		if filepath.Ext(req) == ".png" {
+			t.Errorf("Expected the cached artwork not to be loaded again but loaded %s", req)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AtomFeed is the Atom (RFC 4287) rendering of a channel
+type AtomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []AtomHref  `xml:"link"`
+	Logo     string      `xml:"logo,omitempty"`
+	Entries  []AtomEntry `xml:"entry"`
+}
+
+type AtomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []AtomHref     `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []AtomCategory `xml:"category"`
+}
+
+type AtomHref struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int    `xml:"length,attr,omitempty"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func atomDate(d XMLDate) string {
+	return time.Time(d).Format(time.RFC3339)
+}
+
+// toAtom converts the rss feed, the self link points at the atom document
+func toAtom(rss RSS, selfLink string) AtomFeed {
+	channel := rss.Channel
+	feed := AtomFeed{
+		ID:       selfLink,
+		Title:    channel.Title,
+		Subtitle: channel.Description,
+		Updated:  atomDate(channel.LastBuildDate),
+		Links: []AtomHref{
+			{Href: selfLink, Rel: "self", Type: "application/atom+xml"},
+			{Href: channel.Link.String(), Rel: "alternate", Type: "text/html"},
+		},
+		Logo: channel.Image.URL.String(),
+	}
+	for _, item := range channel.Items {
+		entry := AtomEntry{
+			ID:        item.GUID.Value,
+			Title:     item.Title,
+			Updated:   atomDate(item.PublishDate),
+			Published: atomDate(item.PublishDate),
+			Links: []AtomHref{
+				{Href: item.Link.String(), Rel: "alternate"},
+				{Href: item.Enclosure.URL.String(), Rel: "enclosure", Type: item.Enclosure.Type, Length: item.Enclosure.Length},
+			},
+			Summary: item.Description,
+		}
+		for _, category := range item.Categories {
+			entry.Categories = append(entry.Categories, AtomCategory{Term: category})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func writeAtom(rss RSS, selfLink string) (*bytes.Buffer, error) {
+	out := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err := enc.Encode(toAtom(rss, selfLink)); err != nil {
+		return out, errors.Wrap(err, "Failed to encode atom feed")
+	}
+	return out, nil
+}
+
+// JSONFeed is the JSON Feed 1.1 rendering of a channel
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url,omitempty"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Icon        string         `json:"icon,omitempty"`
+	Items       []JSONFeedItem `json:"items"`
+}
+
+type JSONFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url,omitempty"`
+	Title         string               `json:"title"`
+	ContentText   string               `json:"content_text"`
+	DatePublished string               `json:"date_published"`
+	Image         string               `json:"image,omitempty"`
+	Tags          []string             `json:"tags,omitempty"`
+	Attachments   []JSONFeedAttachment `json:"attachments,omitempty"`
+}
+
+type JSONFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int    `json:"size_in_bytes,omitempty"`
+}
+
+// toJSONFeed converts the rss feed, the feed url points at the json document
+func toJSONFeed(rss RSS, feedURL string) JSONFeed {
+	channel := rss.Channel
+	feed := JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       channel.Title,
+		HomePageURL: channel.Link.String(),
+		FeedURL:     feedURL,
+		Description: channel.Description,
+		Icon:        channel.Image.URL.String(),
+		Items:       []JSONFeedItem{},
+	}
+	for _, item := range channel.Items {
+		feed.Items = append(feed.Items, JSONFeedItem{
+			ID:            item.GUID.Value,
+			URL:           item.Link.String(),
+			Title:         item.Title,
+			ContentText:   item.Description,
+			DatePublished: atomDate(item.PublishDate),
+			Image:         item.ItunesImage.URL.String(),
+			Tags:          item.Categories,
+			Attachments: []JSONFeedAttachment{{
+				URL:         item.Enclosure.URL.String(),
+				MimeType:    item.Enclosure.Type,
+				SizeInBytes: item.Enclosure.Length,
+			}},
+		})
+	}
+	return feed
+}
+
+func writeJSONFeed(rss RSS, feedURL string) (*bytes.Buffer, error) {
+	out := &bytes.Buffer{}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(toJSONFeed(rss, feedURL)); err != nil {
+		return out, errors.Wrap(err, "Failed to encode json feed")
+	}
+	return out, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// buildOptions controls what the static export writes and where
+type buildOptions struct {
+	Dir  string
+	Atom bool
+	JSON bool
+}
+
+// buildReport lists the files touched by a static export
+type buildReport struct {
+	Written   []string
+	Unchanged []string
+	Failed    []string
+}
+
+// feedFile is the file name of the feed for a podcast prefix
+func feedFile(prefix, ext string) string {
+	return strings.Trim(prefix, "/") + ext
+}
+
+// buildSite scrapes every configured podcast and exports the feeds, the
+// master feed, an index page and an opml subscription list as static files.
+// Podcasts which fail to scrape keep their previously exported files, and
+// so do the master and composite feeds they are merged into. With
+// a media directory the media is mirrored first and linked below media/,
+// with an artwork directory the resized artwork is written below artwork/.
+func buildSite(ctx context.Context, config Config, opts buildOptions) (buildReport, error) {
+	logger := loggerFrom(ctx).With("component", "build")
+	report := buildReport{}
+	start := time.Now()
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return report, errors.Wrapf(err, "Failed to create output directory %s", opts.Dir)
+	}
+	var mirror *mediaMirror
+	if config.MediaDir != "" {
+		mirror = newMediaMirror(config.MediaDir)
+	}
+	var artwork *artworkProxy
+	var artworkFiles []string
+	if config.ArtworkDir != "" {
+		artwork = newArtworkProxy(config)
+	}
+	linkArtwork := func(channel *Channel) {
+		if artwork != nil {
+			artworkFiles = append(artworkFiles, artwork.link(channel, func(file string) string { return config.absoluteURL("artwork/" + file) })...)
+		}
+	}
+	built := make(map[string]RSS)
+	for _, podcast := range config.Podcasts {
+		name := feedFile(podcast.Path, "")
+		rss, err := scrapeFeed(ctx, podcast, NewAtomLink(config.absoluteURL(name+".xml")))
+		if err != nil {
+			logger.Error("Failed to scrape podcast", "podcast", podcast.Path, "err", err)
+			report.Failed = append(report.Failed, podcast.Path)
+			continue
+		}
+		stabilizeDates(&rss.Channel)
+		if mirror != nil {
+			mirror.mirrorAll(ctx, enclosureURLs(rss.Channel.Items), 2)
+			mirror.link(&rss.Channel, func(file string) string { return config.absoluteURL("media/" + file) })
+		}
+		linkArtwork(&rss.Channel)
+		if err := report.writeFeeds(config, opts, name, rss); err != nil {
+			return report, err
+		}
+		built[podcast.Path] = rss
+	}
+
+	// the merged feeds reuse the scraped items instead of scraping again
+	merge := func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		rss := NewRSS()
+		rss.Channel = masterChannel(ctx, selfLink)
+		for _, podcast := range podcasts {
+			feed, ok := built[podcast.Path]
+			if !ok {
+				return rss, fmt.Errorf("Failed to scrape podcast %s", podcast.Path)
+			}
+			items := append([]Item{}, feed.Channel.Items...)
+			source, _ := parseURL(config.absoluteURL(feedFile(podcast.Path, ".xml")))
+			tagSource(items, podcast, source)
+			rss.Channel.Items = append(rss.Channel.Items, items...)
+		}
+		rss.Channel.Items = mergeItems(rss.Channel.Items)
+		describeMembers(&rss.Channel, podcasts)
+		stabilizeDates(&rss.Channel)
+		return rss, nil
+	}
+	for _, feed := range config.Feeds {
+		name := feedFile(feed.Path, "")
+		rss, err := compositeBuilder(feed, merge)(ctx, config.Podcasts, NewAtomLink(config.absoluteURL(name+".xml")))
+		if err != nil {
+			logger.Error("Failed to merge feed", "feed", feed.Path, "err", err)
+			report.Failed = append(report.Failed, feed.Path)
+			continue
+		}
+		linkArtwork(&rss.Channel)
+		if err := report.writeFeeds(config, opts, name, rss); err != nil {
+			return report, err
+		}
+	}
+	master, err := masterBuilder(config.master(), merge)(ctx, config.Podcasts, NewAtomLink(config.absoluteURL("master.xml")))
+	if err != nil {
+		logger.Error("Failed to merge feed", "feed", "/master", "err", err)
+		report.Failed = append(report.Failed, "/master")
+	} else {
+		linkArtwork(&master.Channel)
+		if err := report.writeFeeds(config, opts, "master", master); err != nil {
+			return report, err
+		}
+	}
+
+	if artwork != nil {
+		artwork.exportArtwork(ctx, &report, opts.Dir, artworkFiles)
+	}
+
+	page := newIndexPage(config.Podcasts, func(p Podcast) string { return feedFile(p.Path, ".xml") })
+	page.OPML = "podcasts.opml"
+	var index bytes.Buffer
+	if err := indexTemplate.Execute(&index, page); err != nil {
+		return report, errors.Wrap(err, "Failed to render index")
+	}
+	if err := report.write(opts.Dir, "index.html", index.Bytes()); err != nil {
+		return report, err
+	}
+	opml, err := writeOPML(newOPML("RadioCity Podcasts", config.Podcasts, func(p Podcast) string {
+		return config.absoluteURL(feedFile(p.Path, ".xml"))
+	}))
+	if err != nil {
+		return report, err
+	}
+	if err := report.write(opts.Dir, page.OPML, opml.Bytes()); err != nil {
+		return report, err
+	}
+
+	logger.Info("Built static site", "dir", opts.Dir, "written", len(report.Written), "unchanged", len(report.Unchanged), "failed", len(report.Failed), "duration", time.Since(start))
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("Failed to build %d feeds: %s", len(report.Failed), strings.Join(report.Failed, ", "))
+	}
+	return report, nil
+}
+
+// writeFeeds writes the rss feed and the requested alternate formats
+func (report *buildReport) writeFeeds(config Config, opts buildOptions, name string, rss RSS) error {
+	out, err := writeFeed(rss)
+	if err != nil {
+		return err
+	}
+	if err := report.write(opts.Dir, name+".xml", out.Bytes()); err != nil {
+		return err
+	}
+	if opts.Atom {
+		out, err := writeAtom(rss, config.absoluteURL(name+".atom"))
+		if err != nil {
+			return err
+		}
+		if err := report.write(opts.Dir, name+".atom", out.Bytes()); err != nil {
+			return err
+		}
+	}
+	if opts.JSON {
+		out, err := writeJSONFeed(rss, config.absoluteURL(name+".json"))
+		if err != nil {
+			return err
+		}
+		if err := report.write(opts.Dir, name+".json", out.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (report *buildReport) write(dir, name string, buf []byte) error {
+	changed, err := writeIfChanged(filepath.Join(dir, name), buf)
+	if err != nil {
+		return err
+	}
+	if changed {
+		report.Written = append(report.Written, name)
+	} else {
+		report.Unchanged = append(report.Unchanged, name)
+	}
+	return nil
+}
+
+// writeIfChanged replaces the file atomically unless it already has the
+// same content, leaving its modification time untouched for sync tools
+func writeIfChanged(file string, buf []byte) (bool, error) {
+	if existing, err := ioutil.ReadFile(file); err == nil && bytes.Equal(existing, buf) {
+		return false, nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to create temporary file for %s", file)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return false, errors.Wrapf(err, "Failed to write %s", file)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, errors.Wrapf(err, "Failed to write %s", file)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return false, errors.Wrapf(err, "Failed to set permissions of %s", file)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return false, errors.Wrapf(err, "Failed to replace %s", file)
+	}
+	return true, nil
+}
+
+// latestDate is the publish date of the newest item, zero without items
+func latestDate(items []Item) time.Time {
+	var latest time.Time
+	for _, item := range items {
+		if pd := time.Time(item.PublishDate); pd.After(latest) {
+			latest = pd
+		}
+	}
+	return latest
+}
+
+// stabilizeDates dates the channel by its newest item instead of the time
+// of the build so that unchanged feeds render identically
+func stabilizeDates(channel *Channel) {
+	if latest := latestDate(channel.Items); !latest.IsZero() {
+		channel.PublishDate = XMLDate(latest)
+		channel.LastBuildDate = XMLDate(latest)
+	}
+}
+
+// runBuild implements the build command
+func runBuild(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	opts := buildOptions{}
+	fs.StringVar(&opts.Dir, "out", "public", "directory to export the site into")
+	fs.BoolVar(&opts.Atom, "atom", false, "also export atom feeds as <prefix>.atom")
+	fs.BoolVar(&opts.JSON, "json", false, "also export json feeds as <prefix>.json")
+	fs.StringVar(&config.BaseURL, "base-url", config.BaseURL, "absolute url the site is hosted at, used for self links")
+	fs.Parse(args)
+	_, err := buildSite(ctx, config, opts)
+	return err
+}
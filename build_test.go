@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildSite(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	fake := newFakeRadioCity(t)
+	config := Config{BaseURL: "https://feeds.example.com/radio/", Podcasts: podcasts}
+	opts := buildOptions{Dir: t.TempDir(), Atom: true, JSON: true}
+
+	report, err := buildSite(context.Background(), config, opts)
+	if err != nil {
+		t.Fatalf("Failed to build site\n%q", err)
+	}
+	want := []string{"cd.xml", "cd.atom", "cd.json", "kck.xml", "kck.atom", "kck.json", "master.xml", "master.atom", "master.json", "index.html", "podcasts.opml"}
+	if strings.Join(report.Written, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected to write %v but wrote %v", want, report.Written)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(opts.Dir, "cd.xml"))
+	if err != nil {
+		t.Fatalf("Failed to read exported feed\n%q", err)
+	}
+	if !strings.Contains(string(buf), `href="https://feeds.example.com/radio/cd.xml"`) {
+		t.Errorf("Expected an absolute self link in the exported feed")
+	}
+
+	report, err = buildSite(context.Background(), config, opts)
+	if err != nil {
+		t.Fatalf("Failed to rebuild site\n%q", err)
+	}
+	if len(report.Written) != 0 || len(report.Unchanged) != len(want) {
+		t.Errorf("Expected an unchanged rebuild to write nothing but wrote %v", report.Written)
+	}
+
+	// a podcast failing to scrape keeps the feeds it is merged into
+	master, err := ioutil.ReadFile(filepath.Join(opts.Dir, "master.xml"))
+	if err != nil {
+		t.Fatalf("Failed to read exported master feed\n%q", err)
+	}
+	fake.set(func(f *fakeRadioCity) {
+		f.Status["www.radiocity.in"+strings.TrimPrefix(podcasts[0].URL, "https://www.radiocity.in")] = 500
+	})
+	config.Feeds = []CompositeFeed{{Path: "/crime", Title: "Crime", Podcasts: []string{podcasts[0].Path}}}
+	report, err = buildSite(context.Background(), config, opts)
+	if err == nil || strings.Join(report.Failed, ",") != podcasts[0].Path+",/crime,/master" {
+		t.Errorf("Expected the podcast and the feeds merging it to fail but failed %v\n%v", report.Failed, err)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(opts.Dir, "master.xml")); err != nil || string(buf) != string(master) {
+		t.Errorf("Expected the previous master feed to be kept")
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(opts.Dir, "crime.xml")); err == nil {
+		t.Errorf("Expected no composite feed to be written")
+	}
+}
+
+func TestBuildSiteArtwork(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	config := Config{BaseURL: "https://feeds.example.com/radio/", Podcasts: podcasts, ArtworkDir: t.TempDir()}
+	opts := buildOptions{Dir: t.TempDir()}
+	report, err := buildSite(context.Background(), config, opts)
+	if err != nil {
+		t.Fatalf("Failed to build site\n%q", err)
+	}
+	var artwork []string
+	for _, name := range report.Written {
+		if strings.HasPrefix(filepath.ToSlash(name), "artwork/1400/www.radiocity.in/") {
+			artwork = append(artwork, name)
+		}
+	}
+	// the artwork of both podcasts and the master feed logo
+	if len(artwork) != 3 {
+		t.Fatalf("Expected the artwork of the feeds to be written but wrote %v", report.Written)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(opts.Dir, "cd.xml"))
+	if err != nil {
+		t.Fatalf("Failed to read exported feed\n%q", err)
+	}
+	if !strings.Contains(string(buf), `<itunes:image href="https://feeds.example.com/radio/artwork/1400/www.radiocity.in/`) {
+		t.Errorf("Expected the exported feed to link the artwork")
+	}
+}
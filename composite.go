@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CompositeFeed is a named feed combining the episodes of several
+// podcasts, listed by prefix or matched by category and language, eg. all
+// the hindi crime shows
+type CompositeFeed struct {
+	Path        string `json:"prefix"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"imageUrl,omitempty"`
+	// Podcasts are the prefixes of the podcasts always included
+	Podcasts []string `json:"podcasts,omitempty"`
+	// Categories and Language include the podcasts having any of the
+	// categories and the language, the rules are skipped when both are empty
+	Categories []string `json:"categories,omitempty"`
+	Language   string   `json:"language,omitempty"`
+	// PrefixTitles starts the item titles with the name of their show
+	PrefixTitles bool `json:"prefixTitles,omitempty"`
+}
+
+// MasterFeed holds the settings of the master feed, the metadata left
+// empty keeps its default
+type MasterFeed struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Link is the website of the feed, defaults to the feed itself
+	Link      string `json:"link,omitempty"`
+	Image     string `json:"imageUrl,omitempty"`
+	Language  string `json:"language,omitempty"`
+	Copyright string `json:"copyright,omitempty"`
+	// PrefixTitles starts the item titles with the name of their show
+	PrefixTitles bool `json:"prefixTitles,omitempty"`
+	// GUID, Locked and Owner are the podcast namespace settings, see Podcast
+	GUID   string `json:"guid,omitempty"`
+	Locked bool   `json:"locked,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+}
+
+// describe replaces the default metadata of the master channel with the
+// configured metadata
+func (m MasterFeed) describe(ctx context.Context, channel *Channel) {
+	logger := loggerFrom(ctx)
+	if m.Title != "" {
+		channel.Title = m.Title
+		channel.Image.Title = m.Title
+	}
+	if m.Description != "" {
+		channel.Description = m.Description
+	}
+	if m.Link != "" {
+		if link, err := parseURL(m.Link); err != nil {
+			logger.Warn("Failed to parse link", "url", m.Link, "err", err)
+		} else {
+			channel.Link = link
+			channel.Image.Link = link
+		}
+	}
+	if m.Image != "" {
+		if img, err := parseURL(m.Image); err != nil {
+			logger.Warn("Failed to parse image url", "url", m.Image, "err", err)
+		} else {
+			channel.Image.URL = img
+			channel.ItunesImage.URL = img
+		}
+	}
+	if code := languageCode(m.Language); code != "" {
+		channel.Language = code
+	}
+	if m.Copyright != "" {
+		channel.Copyright = m.Copyright
+	}
+	channel.PodcastGUID = m.GUID
+	if m.Locked {
+		channel.PodcastLocked = &PodcastLocked{Owner: m.Owner, Value: "yes"}
+	}
+}
+
+// masterBuilder applies the settings to the feed built by the master
+// builder
+func masterBuilder(settings MasterFeed, master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := master(ctx, podcasts, selfLink)
+		if err != nil {
+			return rss, err
+		}
+		settings.describe(ctx, &rss.Channel)
+		if settings.PrefixTitles {
+			prefixTitles(rss.Channel.Items)
+		}
+		return rss, nil
+	}
+}
+
+// hasRules reports whether the feed matches podcasts by category or language
+func (c CompositeFeed) hasRules() bool {
+	return len(c.Categories) > 0 || c.Language != ""
+}
+
+// matches reports whether the podcast is matched by the category and
+// language rules of the feed
+func (c CompositeFeed) matches(podcast Podcast) bool {
+	if !c.hasRules() {
+		return false
+	}
+	if c.Language != "" && languageCode(c.Language) != languageCode(podcast.Language) {
+		return false
+	}
+	if len(c.Categories) == 0 {
+		return true
+	}
+	for _, want := range c.Categories {
+		for _, category := range podcast.Categories {
+			if strings.EqualFold(want, category) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// members lists the podcasts in the feed in config order
+func (c CompositeFeed) members(podcasts []Podcast) []Podcast {
+	listed := make(map[string]bool)
+	for _, prefix := range c.Podcasts {
+		listed[prefix] = true
+	}
+	var members []Podcast
+	for _, podcast := range podcasts {
+		if listed[podcast.Path] || c.matches(podcast) {
+			members = append(members, podcast)
+		}
+	}
+	return members
+}
+
+// describe replaces the master feed title, description and image of the
+// channel with those of the feed
+func (c CompositeFeed) describe(ctx context.Context, channel *Channel) {
+	channel.Title = c.Title
+	channel.Image.Title = c.Title
+	if c.Description != "" {
+		channel.Description = c.Description
+	}
+	if code := languageCode(c.Language); code != "" {
+		channel.Language = code
+	}
+	if c.Image != "" {
+		img, err := parseURL(c.Image)
+		if err != nil {
+			loggerFrom(ctx).Warn("Failed to parse image url", "url", c.Image, "err", err)
+			return
+		}
+		channel.Image.URL = img
+		channel.ItunesImage.URL = img
+	}
+}
+
+// compositeBuilder builds the feed out of the items of its members merged
+// by the master builder
+func compositeBuilder(feed CompositeFeed, master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		ctx = withLogger(ctx, loggerFrom(ctx).With("feed", feed.Path))
+		rss, err := master(ctx, feed.members(podcasts), selfLink)
+		if err != nil {
+			return rss, err
+		}
+		feed.describe(ctx, &rss.Channel)
+		if feed.PrefixTitles {
+			prefixTitles(rss.Channel.Items)
+		}
+		return rss, nil
+	}
+}
+
+// findComposite returns the composite feed served at the prefix
+func findComposite(feeds []CompositeFeed, prefix string) (CompositeFeed, bool) {
+	for _, feed := range feeds {
+		if feed.Path == prefix {
+			return feed, true
+		}
+	}
+	return CompositeFeed{}, false
+}
+
+// sourceURL links the feed of a podcast relative to the feed it is merged
+// into
+func sourceURL(selfLink AtomLink, podcast Podcast) URL {
+	u := url.URL(selfLink.URL)
+	return URL(*u.ResolveReference(&url.URL{Path: podcast.Path}))
+}
+
+// tagSource marks the items as coming from the podcast at the feed url
+func tagSource(items []Item, podcast Podcast, feedURL URL) {
+	for i := range items {
+		items[i].Source = &Source{URL: feedURL, Name: podcast.Name}
+	}
+}
+
+// mergeItems orders the items of a merged feed newest first and drops the
+// items whose guid or enclosure url was already seen. Items published at
+// the same time keep the order of their podcasts in the config and their
+// order on the page.
+func mergeItems(items []Item) []Item {
+	sort.SliceStable(items, func(i, j int) bool {
+		return time.Time(items[i].PublishDate).After(time.Time(items[j].PublishDate))
+	})
+	seen := make(map[string]bool)
+	merged := items[:0]
+	for _, item := range items {
+		guid, enclosure := "guid "+item.GUID.Value, "url "+item.Enclosure.URL.String()
+		if seen[guid] || seen[enclosure] {
+			continue
+		}
+		if item.GUID.Value != "" {
+			seen[guid] = true
+		}
+		if item.Enclosure.URL.String() != "" {
+			seen[enclosure] = true
+		}
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// prefixTitles starts the titles of the items with the name of the show
+// they come from, unless they already do
+func prefixTitles(items []Item) {
+	for i := range items {
+		source := items[i].Source
+		if source == nil || source.Name == "" {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(items[i].Title), strings.ToLower(source.Name)) {
+			items[i].Title = source.Name + ": " + items[i].Title
+		}
+	}
+}
+
+// validateComposites reports the master and composite feed settings which
+// cannot be served
+func validateComposites(config Config) []string {
+	var problems []string
+	master := config.master()
+	for _, link := range []struct{ name, url string }{{"link", master.Link}, {"imageUrl", master.Image}} {
+		if link.url == "" {
+			continue
+		}
+		if u, err := url.Parse(link.url); err != nil || !u.IsAbs() {
+			problems = append(problems, fmt.Sprintf("master: %s %q is not an absolute url", link.name, link.url))
+		}
+	}
+	if master.Language != "" && languageCode(master.Language) == "" {
+		problems = append(problems, fmt.Sprintf("master: language %q is not a known language", master.Language))
+	}
+	configured, taken := make(map[string]bool), make(map[string]bool)
+	for _, podcast := range config.Podcasts {
+		configured[podcast.Path], taken[podcast.Path] = true, true
+	}
+	for i, feed := range config.Feeds {
+		name := feed.Path
+		if name == "" {
+			name = fmt.Sprintf("feed %d", i+1)
+		}
+		switch {
+		case !strings.HasPrefix(feed.Path, "/"):
+			problems = append(problems, fmt.Sprintf("%s: prefix must start with /", name))
+		case reservedPaths[feed.Path]:
+			problems = append(problems, fmt.Sprintf("%s: prefix is reserved", name))
+		case taken[feed.Path]:
+			problems = append(problems, fmt.Sprintf("%s: prefix is used by more than one podcast or feed", name))
+		}
+		taken[feed.Path] = true
+		if strings.TrimSpace(feed.Title) == "" {
+			problems = append(problems, fmt.Sprintf("%s: title is empty", name))
+		}
+		if feed.Image != "" {
+			if u, err := url.Parse(feed.Image); err != nil || !u.IsAbs() {
+				problems = append(problems, fmt.Sprintf("%s: imageUrl %q is not an absolute url", name, feed.Image))
+			}
+		}
+		if feed.Language != "" && languageCode(feed.Language) == "" {
+			problems = append(problems, fmt.Sprintf("%s: language %q is not a known language", name, feed.Language))
+		}
+		for _, prefix := range feed.Podcasts {
+			if !configured[prefix] {
+				problems = append(problems, fmt.Sprintf("%s: no podcast configured with prefix %s", name, prefix))
+			}
+		}
+		if len(feed.members(config.Podcasts)) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: no podcasts are in the feed", name))
+		}
+	}
+	return problems
+}
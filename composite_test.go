@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompositeMembers(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	for _, test := range []struct {
+		feed CompositeFeed
+		want string
+	}{
+		{CompositeFeed{Podcasts: []string{"/kck"}}, "/kck"},
+		{CompositeFeed{Language: "hindi", Categories: []string{"Crime"}}, "/kck"},
+		{CompositeFeed{Categories: []string{"crime"}}, "/cd,/kck"},
+		{CompositeFeed{Podcasts: []string{"/cd"}, Language: "hi"}, "/cd,/kck"},
+		{CompositeFeed{Language: "tamil", Categories: []string{"comedy"}}, ""},
+	} {
+		var got []string
+		for _, podcast := range test.feed.members(podcasts) {
+			got = append(got, podcast.Path)
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("Expected %+v to have %q but had %v", test.feed, test.want, got)
+		}
+	}
+
+	config := Config{Podcasts: podcasts, Feeds: []CompositeFeed{
+		{Path: "/hindi-crime", Title: "Hindi Crime", Language: "hindi", Categories: []string{"crime"}},
+		{Path: "/cd", Title: "Taken", Podcasts: []string{"/nope"}},
+		{Path: "comedy", Language: "klingon"},
+	}}
+	problems := strings.Join(validateConfig(config), "\n")
+	for _, want := range []string{
+		"/cd: prefix is used by more than one podcast or feed",
+		"/cd: no podcast configured with prefix /nope",
+		"comedy: prefix must start with /",
+		"comedy: title is empty",
+		`comedy: language "klingon" is not a known language`,
+		"comedy: no podcasts are in the feed",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("Expected the problem %q in\n%s", want, problems)
+		}
+	}
+	if strings.Contains(problems, "/hindi-crime") {
+		t.Errorf("Expected /hindi-crime to be valid\n%s", problems)
+	}
+}
+
+func TestCompositeFeed(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	feed := CompositeFeed{
+		Path:        "/hindi-crime",
+		Title:       "Hindi Crime",
+		Description: "Every hindi crime show",
+		Image:       "https://feeds.example.com/hindi-crime.png",
+		Language:    "hindi",
+		Categories:  []string{"crime"},
+	}
+	config := Config{BaseURL: "https://feeds.example.com", Podcasts: podcasts, Feeds: []CompositeFeed{feed}}
+
+	w := httptest.NewRecorder()
+	newServeMux(config, scrapeFeed, buildFeed).ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/hindi-crime", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but was %d", w.Code)
+	}
+	var rss RSS
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("Failed to unmarshal feed xml\n%q", err)
+	}
+	channel := rss.Channel
+	if channel.Title != feed.Title || channel.Description != feed.Description || channel.Language != "hi" {
+		t.Errorf("Expected the channel to be described by the feed but was %q %q %q", channel.Title, channel.Description, channel.Language)
+	}
+	if channel.Image.URL.String() != feed.Image {
+		t.Errorf("Expected the image %s but was %s", feed.Image, channel.Image.URL.String())
+	}
+	if len(channel.Items) == 0 {
+		t.Fatalf("Expected the items of /kck")
+	}
+	for _, item := range channel.Items {
+		if item.Source == nil || item.Source.Name != "Kissa Crime Ka" || item.Source.URL.String() != "http://localhost:8080/kck" {
+			t.Fatalf("Expected every item to come from /kck but was %+v", item.Source)
+		}
+	}
+
+	opts := buildOptions{Dir: t.TempDir()}
+	if _, err := buildSite(context.Background(), config, opts); err != nil {
+		t.Fatalf("Failed to build site\n%q", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(opts.Dir, "hindi-crime.xml"))
+	if err != nil {
+		t.Fatalf("Failed to read exported feed\n%q", err)
+	}
+	if !strings.Contains(string(buf), `<source url="https://feeds.example.com/kck.xml">Kissa Crime Ka</source>`) {
+		t.Errorf("Expected the exported items to link the exported feed of their show")
+	}
+	if strings.Contains(string(buf), "Crime Diary") {
+		t.Errorf("Expected only hindi shows in the exported feed")
+	}
+}
+
+func TestMergeItems(t *testing.T) {
+	day := func(d int) XMLDate { return XMLDate(time.Date(2018, time.October, d, 0, 0, 0, 0, istLocation)) }
+	item := func(title, media string, d int, show string) Item {
+		u, _ := parseURL("https://prc.listenon.in/" + media)
+		return Item{
+			Title:       title,
+			GUID:        GUID{Value: u.String()},
+			PublishDate: day(d),
+			Enclosure:   Enclosure{URL: u},
+			Source:      &Source{Name: show},
+		}
+	}
+	items := []Item{
+		item("Crime Diary EP 1", "cd1.mp3", 1, "Crime Diary"),
+		item("Crime Diary EP 3", "cd3.mp3", 3, "Crime Diary"),
+		item("Crime Diary EP 2", "cd2.mp3", 3, "Crime Diary"),
+		item("Crime Diary EP 3 again", "cd3.mp3", 3, "Crime Diary"),
+		item("Ep 7", "kck7.mp3", 3, "Kissa Crime Ka"),
+		item("Ep 8", "kck8.mp3", 8, "Kissa Crime Ka"),
+	}
+	renamed := item("Ep 8 renamed", "kck8-mirror.mp3", 8, "Kissa Crime Ka")
+	renamed.GUID = items[5].GUID
+	items = append(items, renamed)
+
+	merged := mergeItems(items)
+	prefixTitles(merged)
+	var got []string
+	for _, item := range merged {
+		got = append(got, item.Title)
+	}
+	want := "Kissa Crime Ka: Ep 8,Crime Diary EP 3,Crime Diary EP 2,Kissa Crime Ka: Ep 7,Crime Diary EP 1"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Expected the items\n%s\nbut were\n%s", want, strings.Join(got, ","))
+	}
+}
+
+func TestMasterSettings(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	freezeClock(t)
+	settings := MasterFeed{
+		Title:       "All of RadioCity",
+		Description: "Every RadioCity show",
+		Link:        "https://feeds.example.com/",
+		Image:       "https://feeds.example.com/logo.png",
+		Language:    "en",
+		Copyright:   "Radio City",
+	}
+	rss, err := masterBuilder(settings, buildFeed)(context.Background(), podcasts, NewAtomLink("https://feeds.example.com/master"))
+	if err != nil {
+		t.Fatalf("Failed to build master feed\n%q", err)
+	}
+	channel := rss.Channel
+	if channel.Title != settings.Title || channel.Image.Title != settings.Title || channel.Description != settings.Description {
+		t.Errorf("Expected the configured title and description but were %q %q", channel.Title, channel.Description)
+	}
+	if channel.Link.String() != settings.Link || channel.Image.Link.String() != settings.Link {
+		t.Errorf("Expected the configured link but was %s", channel.Link.String())
+	}
+	if channel.Image.URL.String() != settings.Image || channel.ItunesImage.URL.String() != settings.Image {
+		t.Errorf("Expected the configured image but was %s", channel.Image.URL.String())
+	}
+	if channel.Language != "en" || channel.Copyright != settings.Copyright {
+		t.Errorf("Expected the configured language and copyright but were %q %q", channel.Language, channel.Copyright)
+	}
+	if want := time.Time(channel.Items[0].PublishDate); !time.Time(channel.PublishDate).Equal(want) {
+		t.Errorf("Expected the channel to be published with its newest item on %s but was %s", want, time.Time(channel.PublishDate))
+	}
+}
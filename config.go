@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the set of podcasts served along with the settings shared by
+// the commands. A plain json array of podcasts is accepted as well.
+type Config struct {
+	BaseURL  string          `json:"baseUrl,omitempty"`
+	Podcasts []Podcast       `json:"podcasts"`
+	Feeds    []CompositeFeed `json:"feeds,omitempty"`
+	Master   *MasterFeed     `json:"master,omitempty"`
+	// MediaDir mirrors the episode media into the directory and links the
+	// copies from the feeds when set
+	MediaDir string `json:"mediaDir,omitempty"`
+	// VerifyArtwork loads the episode artwork and replaces the images which
+	// do not meet the Apple Podcasts rules with the podcast image
+	VerifyArtwork bool `json:"verifyArtwork,omitempty"`
+	// ArtworkCache is the json file the artwork sizes are kept in between
+	// runs, they are only kept in memory without it
+	ArtworkCache string `json:"artworkCache,omitempty"`
+	// ArtworkDir keeps the artwork padded to a square and resized, the
+	// feeds link it as their itunes image when set
+	ArtworkDir string `json:"artworkDir,omitempty"`
+	// ArtworkSize is the size of the artwork linked, 1400 when not set
+	ArtworkSize int `json:"artworkSize,omitempty"`
+	// WebSub runs a hub at /hub which pushes the feeds to their subscribers
+	// when they have new episodes, and links it from the feeds
+	WebSub bool `json:"websub,omitempty"`
+	// Webhooks are posted the new episodes found by serve and notify
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// WebhookLog is the json file the scraped guids and the deliveries are
+	// kept in so that restarts do not notify again
+	WebhookLog string `json:"webhookLog,omitempty"`
+	// Digest emails the new episodes to the recipients with the digest
+	// command
+	Digest *Digest `json:"digest,omitempty"`
+	// Refresh scrapes the podcasts in the background with serve
+	Refresh *Refresh `json:"refresh,omitempty"`
+}
+
+// master is the master feed settings, the defaults when none are given
+func (c Config) master() MasterFeed {
+	if c.Master == nil {
+		return MasterFeed{}
+	}
+	return *c.Master
+}
+
+type plainConfig Config
+
+func (c *Config) UnmarshalJSON(buf []byte) error {
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		c.Podcasts = nil
+		return json.Unmarshal(trimmed, &c.Podcasts)
+	}
+	return json.Unmarshal(buf, (*plainConfig)(c))
+}
+
+// loadConfig reads the config file, falling back to the built in podcasts
+// when no file is given
+func loadConfig(file string) (Config, error) {
+	config := Config{Podcasts: podcasts}
+	if file == "" {
+		return config, nil
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, errors.Wrapf(err, "Failed to read config file %s", file)
+	}
+	config = Config{}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, errors.Wrapf(err, "Failed to parse config file %s", file)
+	}
+	return config, nil
+}
+
+// absoluteURL joins the base url and a path, the base url defaults to the
+// local development server
+func (c Config) absoluteURL(path string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
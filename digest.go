@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Digest emails the recipients the episodes published since the last run
+type Digest struct {
+	SMTP SMTPServer `json:"smtp"`
+	// From is the sender, eg. "Radio City <feeds@example.com>"
+	From string `json:"from"`
+	// Subject defaults to "New episodes"
+	Subject    string      `json:"subject,omitempty"`
+	Recipients []Recipient `json:"recipients"`
+	// State is the json file the guids of the last run and the digests
+	// not sent yet are kept in, it is required for episodes to be new
+	State string `json:"state"`
+}
+
+// SMTPServer is the server the digests are sent through, STARTTLS is used
+// when the server offers it
+type SMTPServer struct {
+	// Addr is the host:port of the server
+	Addr     string `json:"addr"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Recipient is an email address subscribed to podcasts
+type Recipient struct {
+	Email string `json:"email"`
+	// Podcasts are the prefixes of the podcasts in the digest, all of them
+	// when empty
+	Podcasts []string `json:"podcasts,omitempty"`
+}
+
+func (r Recipient) wants(podcast Podcast) bool {
+	return subscribed(r.Podcasts, podcast)
+}
+
+// digestEpisode is an episode waiting to be sent in a digest
+type digestEpisode struct {
+	Podcast   string    `json:"podcast"`
+	Prefix    string    `json:"prefix"`
+	Title     string    `json:"title"`
+	GUID      string    `json:"guid"`
+	Enclosure string    `json:"enclosureUrl"`
+	Published time.Time `json:"published"`
+}
+
+// digestState is kept between runs, pending are the episodes of each
+// recipient whose digest was not sent yet
+type digestState struct {
+	Seen    map[string][]string        `json:"seen"`
+	Pending map[string][]digestEpisode `json:"pending"`
+	LastRun time.Time                  `json:"lastRun"`
+}
+
+func loadDigestState(file string) (*digestState, error) {
+	state := &digestState{}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Failed to read digest state %s", file)
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, state); err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse digest state %s", file)
+		}
+	}
+	if state.Seen == nil {
+		state.Seen = make(map[string][]string)
+	}
+	if state.Pending == nil {
+		state.Pending = make(map[string][]digestEpisode)
+	}
+	return state, nil
+}
+
+func (s *digestState) save(file string) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return errors.Wrap(err, "Failed to create digest state directory")
+	}
+	_, err = writeIfChanged(file, buf)
+	return err
+}
+
+// collectDigests scrapes the podcasts of the recipients and adds the
+// episodes new since the last run to their pending digests. The first run
+// only records the episodes. The pending digests of recipients no longer
+// in the config are dropped.
+func collectDigests(ctx context.Context, config Config, state *digestState) {
+	logger := loggerFrom(ctx).With("component", "digest")
+	configured := make(map[string]bool)
+	for _, recipient := range config.Digest.Recipients {
+		configured[recipient.Email] = true
+	}
+	for email, episodes := range state.Pending {
+		if !configured[email] {
+			logger.Info("Dropped the digest of a removed recipient", "to", email, "episodes", len(episodes))
+			delete(state.Pending, email)
+		}
+	}
+	for _, podcast := range config.Podcasts {
+		var recipients []Recipient
+		for _, recipient := range config.Digest.Recipients {
+			if recipient.wants(podcast) {
+				recipients = append(recipients, recipient)
+			}
+		}
+		if len(recipients) == 0 {
+			continue
+		}
+		items, err := scrapeItems(ctx, podcast)
+		if err != nil {
+			logger.Warn("Failed to scrape podcast", "podcast", podcast.Path, "err", err)
+			continue
+		}
+		previous, scraped := state.Seen[podcast.Path]
+		fresh, guids := freshItems(items, previous, scraped)
+		for _, item := range fresh {
+			episode := digestEpisode{
+				Podcast:   podcast.Name,
+				Prefix:    podcast.Path,
+				Title:     item.Title,
+				GUID:      item.GUID.Value,
+				Enclosure: item.Enclosure.URL.String(),
+				Published: time.Time(item.PublishDate),
+			}
+			for _, recipient := range recipients {
+				state.Pending[recipient.Email] = append(state.Pending[recipient.Email], episode)
+			}
+		}
+		state.Seen[podcast.Path] = guids
+	}
+}
+
+// digestSince is the publish date of the oldest episode of a digest, so
+// that a digest kept after failing to send still covers all its episodes
+func digestSince(episodes []digestEpisode) time.Time {
+	var since time.Time
+	for _, episode := range episodes {
+		if !episode.Published.IsZero() && (since.IsZero() || episode.Published.Before(since)) {
+			since = episode.Published
+		}
+	}
+	return since
+}
+
+// digestPodcast groups the episodes of a podcast in a digest
+type digestPodcast struct {
+	Name     string
+	Feed     string
+	Episodes []digestEpisode
+}
+
+// digestPage is the data rendered by the digest templates
+type digestPage struct {
+	Subject  string
+	Since    time.Time
+	Podcasts []digestPodcast
+}
+
+func newDigestPage(config Config, subject string, since time.Time, episodes []digestEpisode) digestPage {
+	page := digestPage{Subject: subject, Since: since}
+	index := make(map[string]int)
+	for _, episode := range episodes {
+		i, ok := index[episode.Prefix]
+		if !ok {
+			i = len(page.Podcasts)
+			index[episode.Prefix] = i
+			page.Podcasts = append(page.Podcasts, digestPodcast{Name: episode.Podcast, Feed: config.absoluteURL(episode.Prefix)})
+		}
+		page.Podcasts[i].Episodes = append(page.Podcasts[i].Episodes, episode)
+	}
+	return page
+}
+
+var digestText = template.Must(template.New("text").Parse(`{{.Subject}}{{if not .Since.IsZero}} since {{.Since.Format "2 Jan 2006"}}{{end}}
+{{range .Podcasts}}
+{{.Name}} ({{.Feed}})
+{{range .Episodes}}
+* {{.Title}}{{if not .Published.IsZero}}, {{.Published.Format "2 Jan 2006"}}{{end}}
+  {{.Enclosure}}
+{{end}}{{end}}`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Subject}}</title></head>
+<body>
+<h1>{{.Subject}}</h1>
+{{if not .Since.IsZero}}<p>Since {{.Since.Format "2 Jan 2006"}}</p>{{end}}
+{{range .Podcasts}}<h2><a href="{{.Feed}}">{{.Name}}</a></h2>
+<ul>
+{{range .Episodes}}<li><a href="{{.Enclosure}}">{{.Title}}</a>{{if not .Published.IsZero}} <small>{{.Published.Format "2 Jan 2006"}}</small>{{end}}</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// digestMessage renders the digest of the episodes as a multipart email
+// with a plain text and an html part
+func digestMessage(config Config, to string, since time.Time, episodes []digestEpisode) ([]byte, error) {
+	subject := config.Digest.Subject
+	if subject == "" {
+		subject = "New episodes"
+	}
+	page := newDigestPage(config, subject, since, episodes)
+	from, err := mail.ParseAddress(config.Digest.From)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse from address %q", config.Digest.From)
+	}
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var msg bytes.Buffer
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, part := range []struct {
+		ctype  string
+		render func(io.Writer) error
+	}{
+		{"text/plain", func(w io.Writer) error { return digestText.Execute(w, page) }},
+		{"text/html", func(w io.Writer) error { return digestHTML.Execute(w, page) }},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.ctype + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if err := part.render(qp); err != nil {
+			return nil, errors.Wrapf(err, "Failed to render %s digest", part.ctype)
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// send sends the message through the server, authenticating when a
+// username is configured
+func (s SMTPServer) send(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse smtp addr %s", s.Addr)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, from, to, msg)
+}
+
+// sendDigests collects the new episodes and emails every recipient with
+// pending episodes their digest. Digests which fail to send are kept and
+// sent with the next run. With dryRun the messages are written to it
+// instead of being sent.
+func sendDigests(ctx context.Context, config Config, dryRun io.Writer) (sent int, err error) {
+	logger := loggerFrom(ctx).With("component", "digest")
+	state, err := loadDigestState(config.Digest.State)
+	if err != nil {
+		return 0, err
+	}
+	collectDigests(ctx, config, state)
+	from, err := mail.ParseAddress(config.Digest.From)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to parse from address %q", config.Digest.From)
+	}
+	var failed []string
+	for _, recipient := range config.Digest.Recipients {
+		episodes := state.Pending[recipient.Email]
+		if len(episodes) == 0 {
+			continue
+		}
+		msg, err := digestMessage(config, recipient.Email, digestSince(episodes), episodes)
+		if err != nil {
+			return sent, err
+		}
+		if dryRun != nil {
+			dryRun.Write(msg)
+			continue
+		}
+		if err := config.Digest.SMTP.send(from.Address, []string{recipient.Email}, msg); err != nil {
+			logger.Warn("Failed to send digest", "to", recipient.Email, "episodes", len(episodes), "err", err)
+			failed = append(failed, recipient.Email)
+			continue
+		}
+		logger.Info("Sent digest", "to", recipient.Email, "episodes", len(episodes))
+		delete(state.Pending, recipient.Email)
+		sent++
+	}
+	if dryRun != nil {
+		return sent, nil
+	}
+	state.LastRun = now()
+	if err := state.save(config.Digest.State); err != nil {
+		return sent, errors.Wrap(err, "Failed to save digest state")
+	}
+	if len(failed) > 0 {
+		return sent, fmt.Errorf("Failed to send the digest to %s", strings.Join(failed, ", "))
+	}
+	return sent, nil
+}
+
+// validateDigest reports the digest config which cannot be sent
+func validateDigest(config Config) []string {
+	digest := config.Digest
+	if digest == nil {
+		return nil
+	}
+	var problems []string
+	if _, _, err := net.SplitHostPort(digest.SMTP.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("digest: smtp addr %q is not a host:port", digest.SMTP.Addr))
+	}
+	if _, err := mail.ParseAddress(digest.From); err != nil {
+		problems = append(problems, fmt.Sprintf("digest: from %q is not an email address", digest.From))
+	}
+	if digest.State == "" {
+		problems = append(problems, "digest: no state file")
+	}
+	configured := make(map[string]bool)
+	for _, podcast := range config.Podcasts {
+		configured[podcast.Path] = true
+	}
+	for _, recipient := range digest.Recipients {
+		if _, err := mail.ParseAddress(recipient.Email); err != nil {
+			problems = append(problems, fmt.Sprintf("digest: recipient %q is not an email address", recipient.Email))
+		}
+		for _, prefix := range recipient.Podcasts {
+			if !configured[prefix] {
+				problems = append(problems, fmt.Sprintf("digest: %s: no podcast configured with prefix %s", recipient.Email, prefix))
+			}
+		}
+	}
+	return problems
+}
+
+// runDigest implements the digest command, meant to be run from cron
+func runDigest(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the emails instead of sending them, nothing is recorded")
+	fs.Parse(args)
+	if config.Digest == nil {
+		return fmt.Errorf("No digest configured")
+	}
+	if problems := validateDigest(config); len(problems) > 0 {
+		return fmt.Errorf("Invalid config: %s", strings.Join(problems, "; "))
+	}
+	var out io.Writer
+	if *dryRun {
+		out = os.Stdout
+	}
+	sent, err := sendDigests(ctx, config, out)
+	if !*dryRun {
+		fmt.Printf("%d digests sent\n", sent)
+	}
+	return err
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is a local SMTP server which records the messages sent to it
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []smtpMessage
+	// Reject refuses every recipient
+	Reject bool
+}
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen\n%q", err)
+	}
+	s := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP")
+	var msg smtpMessage
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "HELO", "NOOP", "RSET":
+			c.PrintfLine("250 OK")
+		case "AUTH":
+			c.PrintfLine("235 Authenticated")
+		case "MAIL":
+			msg = smtpMessage{From: strings.Trim(line[strings.Index(line, ":")+1:], "<> ")}
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.Reject
+			s.mu.Unlock()
+			if reject {
+				c.PrintfLine("550 No such user")
+				continue
+			}
+			msg.To = append(msg.To, strings.Trim(line[strings.Index(line, ":")+1:], "<> "))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			msg.Data, err = c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) sent() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+// digestParts reads the plain text and html parts of a digest
+func digestParts(t *testing.T, data []byte) (*mail.Message, map[string]string) {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(data))))
+	if err != nil {
+		t.Fatalf("Failed to read message\n%q", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected a multipart/alternative message but was %s", msg.Header.Get("Content-Type"))
+	}
+	parts := make(map[string]string)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		ctype, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[ctype] = string(body)
+	}
+	return msg, parts
+}
+
+func TestDigest(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	server := newFakeSMTP(t)
+	ctx := context.Background()
+	config := Config{
+		BaseURL:  "https://feeds.example.com",
+		Podcasts: podcasts[:2],
+		Digest: &Digest{
+			SMTP:    SMTPServer{Addr: server.ln.Addr().String(), Username: "feeds", Password: "secret"},
+			From:    "Radio City <feeds@example.com>",
+			Subject: "புதிய அத்தியாயங்கள்",
+			Recipients: []Recipient{
+				{Email: "all@example.com"},
+				{Email: "one@example.com", Podcasts: []string{podcasts[1].Path}},
+			},
+			State: filepath.Join(t.TempDir(), "digest.json"),
+		},
+	}
+	if problems := validateDigest(config); len(problems) != 0 {
+		t.Fatalf("Expected the digest to be valid but was %v", problems)
+	}
+	if sent, err := sendDigests(ctx, config, nil); err != nil || sent != 0 {
+		t.Fatalf("Expected the first run only to record the episodes but sent %d\n%q", sent, err)
+	}
+
+	// forget the latest episode of both podcasts as if they were published since
+	state, err := loadDigestState(config.Digest.State)
+	if err != nil {
+		t.Fatalf("Failed to load the state\n%q", err)
+	}
+	latest := make(map[string]string)
+	for _, podcast := range config.Podcasts {
+		latest[podcast.Path] = state.Seen[podcast.Path][0]
+		state.Seen[podcast.Path] = state.Seen[podcast.Path][1:]
+	}
+	if err := state.save(config.Digest.State); err != nil {
+		t.Fatalf("Failed to save the state\n%q", err)
+	}
+
+	server.Reject = true
+	if _, err := sendDigests(ctx, config, nil); err == nil {
+		t.Fatalf("Expected the rejected digests to fail")
+	}
+	if state, _ = loadDigestState(config.Digest.State); len(state.Pending["all@example.com"]) != 2 || len(state.Pending["one@example.com"]) != 1 {
+		t.Fatalf("Expected the digests to be kept for the next run but were %v", state.Pending)
+	}
+	since := digestSince(state.Pending["all@example.com"])
+	if since.IsZero() {
+		t.Fatalf("Expected the pending episodes to have a publish date")
+	}
+	// a recipient removed from the config
+	state.Pending["gone@example.com"] = state.Pending["one@example.com"]
+	if err := state.save(config.Digest.State); err != nil {
+		t.Fatalf("Failed to save the state\n%q", err)
+	}
+
+	server.Reject = false
+	if sent, err := sendDigests(ctx, config, nil); err != nil || sent != 2 {
+		t.Fatalf("Expected 2 digests to be sent but sent %d\n%q", sent, err)
+	}
+	messages := server.sent()
+	if len(messages) != 2 || messages[0].From != "feeds@example.com" || messages[0].To[0] != "all@example.com" || messages[1].To[0] != "one@example.com" {
+		t.Fatalf("Expected a digest to each recipient but were %v", messages)
+	}
+	msg, parts := digestParts(t, messages[0].Data)
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != config.Digest.Subject {
+		t.Errorf("Expected the subject %s but was %s", config.Digest.Subject, subject)
+	}
+	for _, podcast := range config.Podcasts {
+		for _, want := range []string{podcast.Name, "https://feeds.example.com" + podcast.Path, latest[podcast.Path]} {
+			if !strings.Contains(parts["text/plain"], want) || !strings.Contains(parts["text/html"], want) {
+				t.Errorf("Expected both parts of the digest to contain %s", want)
+			}
+		}
+	}
+	if want := "since " + since.Format("2 Jan 2006"); !strings.Contains(parts["text/plain"], want) {
+		t.Errorf("Expected the digest to cover the episodes %s", want)
+	}
+	if state, _ = loadDigestState(config.Digest.State); len(state.Pending) != 0 {
+		t.Errorf("Expected no pending digests but were %v", state.Pending)
+	}
+	if _, parts := digestParts(t, messages[1].Data); strings.Contains(parts["text/plain"], config.Podcasts[0].Name) {
+		t.Errorf("Expected the digest to only have the subscribed podcasts")
+	}
+
+	if sent, err := sendDigests(ctx, config, nil); err != nil || sent != 0 || len(server.sent()) != 2 {
+		t.Errorf("Expected no digest without new episodes but sent %d", sent)
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+	config := Config{
+		Podcasts: []Podcast{{Path: "/cd"}},
+		Digest: &Digest{
+			SMTP:       SMTPServer{Addr: "smtp.example.com"},
+			From:       "feeds",
+			Recipients: []Recipient{{Email: "a@example.com", Podcasts: []string{"/nope"}}},
+		},
+	}
+	for _, want := range []string{"smtp addr", "from", "no state file", "prefix /nope"} {
+		found := false
+		for _, problem := range validateDigest(config) {
+			found = found || strings.Contains(problem, want)
+		}
+		if !found {
+			t.Errorf("Expected a problem with %s", want)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+)
+
+const radioCityURL = "https://www.radiocity.in"
+
+// Category is a listing page of podcasts linked from the landing page
+type Category struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// skippedPage is a page which could not be scraped during discovery
+type skippedPage struct {
+	URL string
+	Err error
+}
+
+// discoveryReport is the outcome of a discovery run
+type discoveryReport struct {
+	Podcasts []Podcast
+	Skipped  []skippedPage
+}
+
+// scrapeChannelImage loads the show page of each podcast for its image, a
+// show page which fails to load is skipped leaving the image empty
+func scrapeChannelImage(ctx context.Context, in <-chan Podcast, out chan<- Podcast, skip func(string, error)) {
+	for pod := range in {
+		if buf, err := loadUrl(ctx, pod.URL); err != nil {
+			skip(pod.URL, errors.Wrap(err, "Failed to load podcast detail page"))
+		} else if doc, err := goquery.NewDocumentFromReader(bytes.NewReader(buf)); err != nil {
+			skip(pod.URL, errors.Wrap(err, "Failed to parse podcast detail page"))
+		} else if imgUrl, ok := doc.Find(".pod_desc_img img").First().Attr("src"); ok {
+			pod.Image = imgUrl
+			if page, err := url.Parse(pod.URL); err == nil {
+				if img, err := normalizeURL(imgUrl, page); err == nil {
+					pod.Image = img.String()
+				}
+			}
+		}
+		select {
+		case out <- pod:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scrapeCategory lists the podcasts of each category page, a category
+// page which fails to load is skipped
+func scrapeCategory(ctx context.Context, cats <-chan Category, pods chan<- Podcast, skip func(string, error)) {
+	for category := range cats {
+		buf, err := loadUrl(ctx, category.URL)
+		if err != nil {
+			skip(category.URL, errors.Wrap(err, "Failed to load category page"))
+			continue
+		}
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(buf))
+		if err != nil {
+			skip(category.URL, errors.Wrap(err, "Failed to parse category page"))
+			continue
+		}
+		base, _ := url.Parse(category.URL)
+		language := inferLanguage(category.URL)
+		var found []Podcast
+		doc.Find(".podcast_button").Each(func(i int, s *goquery.Selection) {
+			href := strings.TrimSpace(s.Find("a").First().AttrOr("href", ""))
+			link, err := base.Parse(href)
+			if href == "" || err != nil {
+				skip(category.URL, fmt.Errorf("Podcast %q has no valid link", strings.TrimSpace(s.Find("p").Text())))
+				return
+			}
+			found = append(found, Podcast{
+				Name:     strings.TrimSpace(s.Find("p").Text()),
+				URL:      link.String(),
+				Language: language,
+			})
+		})
+		for _, pod := range found {
+			select {
+			case pods <- pod:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// makePath builds a prefix from the initials of the words in the name
+func makePath(name string) string {
+	var b strings.Builder
+	b.WriteString("/")
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				b.WriteRune(unicode.ToLower(r))
+				break
+			}
+		}
+	}
+	if b.Len() == 1 {
+		b.WriteString("podcast")
+	}
+	return b.String()
+}
+
+// inferLanguage picks the language out of show urls such as
+// /radiocity/show-podcasts-tamil/Crime-Diary/153 or category urls such as
+// /radiocity/tamil-podcasts
+func inferLanguage(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	for _, segment := range strings.Split(strings.ToLower(u.Path), "/") {
+		if strings.HasPrefix(segment, "show-podcasts-") {
+			return strings.TrimPrefix(segment, "show-podcasts-")
+		}
+		if strings.HasSuffix(segment, "-podcasts") {
+			return strings.TrimSuffix(segment, "-podcasts")
+		}
+	}
+	return ""
+}
+
+// finalize fills in the language of the discovered podcasts and gives them
+// unique prefixes, podcasts already in the existing config keep their
+// prefix and categories. The listings are by language only, so the
+// categories of new podcasts are left for the config. The result is
+// ordered by prefix.
+func finalize(discovered map[string]Podcast, existing []Podcast) []Podcast {
+	known := make(map[string]Podcast)
+	taken := make(map[string]bool)
+	for path := range reservedPaths {
+		taken[path] = true
+	}
+	for _, pod := range existing {
+		known[pod.URL] = pod
+		taken[pod.Path] = true
+	}
+	urls := make([]string, 0, len(discovered))
+	for u := range discovered {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	podcasts := make([]Podcast, 0, len(urls))
+	for _, u := range urls {
+		pod := discovered[u]
+		if language := inferLanguage(pod.URL); language != "" {
+			pod.Language = language
+		}
+		if old, ok := known[u]; ok {
+			pod.Path = old.Path
+			pod.Categories = old.Categories
+			if pod.Image == "" {
+				pod.Image = old.Image
+			}
+		} else {
+			pod.Path = uniquePath(makePath(pod.Name), taken)
+			pod.Categories = []string{}
+		}
+		podcasts = append(podcasts, pod)
+	}
+	sort.Slice(podcasts, func(i, j int) bool {
+		return podcasts[i].Path < podcasts[j].Path
+	})
+	return podcasts
+}
+
+// uniquePath suffixes the path with a number when it is already taken
+func uniquePath(path string, taken map[string]bool) string {
+	unique := path
+	for i := 2; taken[unique]; i++ {
+		unique = path + strconv.Itoa(i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// diffPodcasts describes how the discovered podcasts differ from the
+// existing config, matching podcasts by their url
+func diffPodcasts(existing, discovered []Podcast) []string {
+	found := make(map[string]Podcast)
+	for _, pod := range discovered {
+		found[pod.URL] = pod
+	}
+	known := make(map[string]bool)
+	var lines []string
+	for _, old := range existing {
+		known[old.URL] = true
+		pod, ok := found[old.URL]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("- %s %s (%s) no longer listed", old.Path, old.Name, old.URL))
+			continue
+		}
+		if pod.Name != old.Name {
+			lines = append(lines, fmt.Sprintf("~ %s name %q -> %q", old.Path, old.Name, pod.Name))
+		}
+		if pod.Image != old.Image {
+			lines = append(lines, fmt.Sprintf("~ %s imageUrl %q -> %q", old.Path, old.Image, pod.Image))
+		}
+		if pod.Language != old.Language {
+			lines = append(lines, fmt.Sprintf("~ %s language %q -> %q", old.Path, old.Language, pod.Language))
+		}
+	}
+	for _, pod := range discovered {
+		if !known[pod.URL] {
+			lines = append(lines, fmt.Sprintf("+ %s %s (%s)", pod.Path, pod.Name, pod.URL))
+		}
+	}
+	return lines
+}
+
+// mergeDiscovered keeps the existing podcasts, updated with what was
+// discovered, followed by the newly discovered ones
+func mergeDiscovered(existing, discovered []Podcast) []Podcast {
+	found := make(map[string]Podcast)
+	for _, pod := range discovered {
+		found[pod.URL] = pod
+	}
+	known := make(map[string]bool)
+	merged := make([]Podcast, 0, len(existing)+len(discovered))
+	for _, old := range existing {
+		known[old.URL] = true
+		if pod, ok := found[old.URL]; ok {
+			old.Name, old.Image, old.Language = pod.Name, pod.Image, pod.Language
+		}
+		merged = append(merged, old)
+	}
+	for _, pod := range discovered {
+		if !known[pod.URL] {
+			merged = append(merged, pod)
+		}
+	}
+	return merged
+}
+
+// parseLandingPage returns the podcast categories and the podcasts linked
+// directly from the podcast menu of the landing page
+func parseLandingPage(reader io.Reader) ([]Category, []Podcast, error) {
+	var cats []Category
+	var pods []Podcast
+	doc, err := goquery.NewDocumentFromReader(reader)
+	if err != nil {
+		return cats, pods, errors.Wrap(err, "Failed to parse response html")
+	}
+	li := doc.Find(`li a:matchesOwn(^Podcast$)`).Parent()
+	if li.Length() == 0 {
+		return cats, pods, fmt.Errorf("Failed to match root element")
+	}
+	li.Find("a").Each(func(i int, s *goquery.Selection) {
+		if !strings.HasPrefix(s.AttrOr("href", ""), "http") {
+			return
+		}
+		link, err := url.Parse(s.AttrOr("href", ""))
+		if err != nil {
+			return
+		}
+		lastFrag := link.Path[strings.LastIndex(link.Path, "/")+1:]
+		if _, err := strconv.Atoi(lastFrag); err != nil {
+			cats = append(cats, Category{strings.TrimSpace(s.Text()), link.String()})
+		} else {
+			pods = append(pods, Podcast{
+				Name: strings.TrimSpace(s.Text()),
+				URL:  link.String(),
+			})
+		}
+	})
+	return cats, pods, nil
+}
+
+// discoverPodcasts crawls the landing page and its podcast categories for
+// every listed podcast, merged with the existing podcasts. Only a landing
+// page which cannot be loaded fails discovery, category and show pages
+// which fail are skipped and reported. The crawl is staged as
+//
+//	categories -> category workers -> unique podcasts -> show workers
+//
+// with each stage closing its output once its workers are done, so that
+// cancelling the context stops every goroutine.
+func discoverPodcasts(ctx context.Context, baseUrl string, existing []Podcast, workerCount int) (discoveryReport, error) {
+	logger := loggerFrom(ctx).With("component", "discover")
+	report := discoveryReport{}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	buf, err := loadUrl(ctx, baseUrl)
+	if err != nil {
+		return report, errors.Wrapf(err, "Failed to load %s", baseUrl)
+	}
+	categories, listed, err := parseLandingPage(bytes.NewReader(buf))
+	if err != nil {
+		return report, err
+	}
+	logger.Info("Loaded landing page", "categories", len(categories), "podcasts", len(listed))
+
+	var mu sync.Mutex
+	skip := func(link string, err error) {
+		logger.Debug("Skipping page", "url", link, "err", err)
+		mu.Lock()
+		defer mu.Unlock()
+		report.Skipped = append(report.Skipped, skippedPage{URL: link, Err: err})
+	}
+
+	cats := make(chan Category)
+	go func() {
+		defer close(cats)
+		for _, category := range categories {
+			select {
+			case cats <- category:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	pods := make(chan Podcast)
+	var catWg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		catWg.Add(1)
+		go func() {
+			defer catWg.Done()
+			scrapeCategory(ctx, cats, pods, skip)
+		}()
+	}
+	go func() {
+		defer close(pods)
+		for _, pod := range listed {
+			select {
+			case pods <- pod:
+			case <-ctx.Done():
+			}
+		}
+		catWg.Wait()
+	}()
+
+	unique := make(chan Podcast)
+	go func() {
+		defer close(unique)
+		seen := make(map[string]bool)
+		for pod := range pods {
+			if seen[pod.URL] {
+				continue
+			}
+			seen[pod.URL] = true
+			select {
+			case unique <- pod:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	out := make(chan Podcast)
+	var showWg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		showWg.Add(1)
+		go func() {
+			defer showWg.Done()
+			scrapeChannelImage(ctx, unique, out, skip)
+		}()
+	}
+	go func() {
+		showWg.Wait()
+		close(out)
+	}()
+
+	podMap := make(map[string]Podcast)
+	for pod := range out {
+		podMap[pod.URL] = pod
+	}
+	if err := ctx.Err(); err != nil {
+		return report, errors.Wrap(err, "Discovery cancelled")
+	}
+	report.Podcasts = finalize(podMap, existing)
+	logger.Info("Discovery completed", "podcasts", len(report.Podcasts), "skipped", len(report.Skipped))
+	return report, nil
+}
+
+// runDiscover implements the discover command, the configured podcasts
+// keep their prefixes and the result is written in the config format
+func runDiscover(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	out := fs.String("o", "", "write the updated config to this file instead of stdout")
+	diff := fs.Bool("diff", false, "only print how the discovered podcasts differ from the config")
+	workers := fs.Int("workers", 3, "number of pages to scrape concurrently")
+	baseUrl := fs.String("url", radioCityURL, "landing page to discover podcasts from")
+	fs.Parse(args)
+
+	report, err := discoverPodcasts(ctx, *baseUrl, config.Podcasts, *workers)
+	if err != nil {
+		return err
+	}
+	discovered := report.Podcasts
+	logger := loggerFrom(ctx).With("component", "discover")
+	for _, page := range report.Skipped {
+		logger.Warn("Skipped page", "url", page.URL, "err", page.Err)
+	}
+	if *diff {
+		for _, line := range diffPodcasts(config.Podcasts, discovered) {
+			fmt.Println(line)
+		}
+		return nil
+	}
+	for _, line := range diffPodcasts(config.Podcasts, discovered) {
+		logger.Info("Discovered change", "change", line)
+	}
+	config.Podcasts = mergeDiscovered(config.Podcasts, discovered)
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode config")
+	}
+	buf = append(buf, '\n')
+	if *out == "" {
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	_, err = writeIfChanged(*out, buf)
+	return err
+}
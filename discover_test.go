@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMakePath(t *testing.T) {
+	tests := map[string]string{
+		"Crime Diary":        "/cd",
+		"Kissa  Crime Ka":    "/kck",
+		" Love Guru ":        "/lg",
+		"RJ's (Special) Day": "/rsd",
+		"":                   "/podcast",
+	}
+	for name, want := range tests {
+		if got := makePath(name); got != want {
+			t.Errorf("Expected path %s for %q but was %s", want, name, got)
+		}
+	}
+}
+
+func TestInferLanguage(t *testing.T) {
+	tests := map[string]string{
+		"https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153":   "tamil",
+		"https://www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82": "hindi",
+		"https://www.radiocity.in/radiocity/tamil-podcasts":                        "tamil",
+		"https://www.radiocity.in/radiocity/podcasts":                              "",
+	}
+	for link, want := range tests {
+		if got := inferLanguage(link); got != want {
+			t.Errorf("Expected language %q for %s but was %q", want, link, got)
+		}
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	discovered := map[string]Podcast{
+		"https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153":   {Name: "Crime Diary", URL: "https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153"},
+		"https://www.radiocity.in/radiocity/show-podcasts-hindi/Cine-Dhamaka/90":   {Name: "Cine Dhamaka", URL: "https://www.radiocity.in/radiocity/show-podcasts-hindi/Cine-Dhamaka/90"},
+		"https://www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82": {Name: "Kissa Crime Ka", URL: "https://www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82"},
+	}
+	existing := []Podcast{
+		{Path: "/cd", Name: "Crime Diary", URL: "https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153", Categories: []string{"crime", "podcast"}},
+		{Path: "/gone", Name: "Gone", URL: "https://www.radiocity.in/radiocity/show-podcasts-tamil/Gone/1"},
+	}
+	podcasts := finalize(discovered, existing)
+	var paths []string
+	for _, pod := range podcasts {
+		paths = append(paths, pod.Path)
+	}
+	if strings.Join(paths, ",") != "/cd,/cd2,/kck" {
+		t.Errorf("Expected unique prefixes in order but got %v", paths)
+	}
+	if podcasts[0].Name != "Crime Diary" || podcasts[0].Categories[0] != "crime" {
+		t.Errorf("Expected the existing podcast to keep its prefix and categories but got %v", podcasts[0])
+	}
+	if podcasts[1].Language != "hindi" || len(podcasts[1].Categories) != 0 {
+		t.Errorf("Expected the language to be inferred and no categories but got %v", podcasts[1])
+	}
+	diff := diffPodcasts(existing, podcasts)
+	if len(diff) != 4 || !strings.HasPrefix(diff[0], "~ /cd language") || !strings.HasPrefix(diff[1], "- /gone") || !strings.HasPrefix(diff[2], "+ /cd2") {
+		t.Errorf("Unexpected diff\n%s", strings.Join(diff, "\n"))
+	}
+	if merged := mergeDiscovered(existing, podcasts); len(merged) != 4 || merged[1].Path != "/gone" {
+		t.Errorf("Expected existing podcasts to be kept ahead of new ones but got %v", merged)
+	}
+}
+
+func TestDiscoverPodcasts(t *testing.T) {
+	fake := newFakeRadioCity(t)
+	existing := []Podcast{{
+		Path:       "/kissa",
+		Name:       "Kissa Crime Ka",
+		URL:        "https://www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82",
+		Categories: []string{"crime"},
+	}}
+	report, err := discoverPodcasts(context.Background(), radioCityURL+"/", existing, 3)
+	if err != nil {
+		t.Fatalf("Failed to discover podcasts\n%q", err)
+	}
+	images := make(map[string]string)
+	for i, pod := range report.Podcasts {
+		if i > 0 && report.Podcasts[i-1].Path >= pod.Path {
+			t.Errorf("Expected podcasts ordered by unique prefix but %s follows %s", pod.Path, report.Podcasts[i-1].Path)
+		}
+		images[pod.Path] = path.Base(pod.Image)
+	}
+	for prefix, image := range map[string]string{
+		"/cd":    "CrimeDiary%20Podcast40kb1493819764.jpg",
+		"/kissa": "kisacrimeka1490279213.jpg",
+		"/es":    ".",
+		"/lg":    ".",
+		"/r":     ".",
+	} {
+		if got, ok := images[prefix]; !ok || got != image {
+			t.Errorf("Expected %s to be discovered with image %q but was %q", prefix, image, got)
+		}
+	}
+	skipped := make(map[string]bool)
+	for _, page := range report.Skipped {
+		skipped[page.URL] = true
+	}
+	for _, link := range []string{
+		"https://www.radiocity.in/radiocity/kannada-podcasts",
+		"https://www.radiocity.in/radiocity/show-podcasts-tamil/Love-Guru/73",
+		"https://www.radiocity.in/radiocity/show-podcasts/udaipur/Murari-Lal/649",
+	} {
+		if !skipped[link] {
+			t.Errorf("Expected %s to be skipped", link)
+		}
+	}
+	for _, page := range []string{"www.radiocity.in/radiocity/tamil-podcasts", "www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82"} {
+		count := 0
+		for _, req := range fake.Requests() {
+			if req == page {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("Expected %s to be loaded once but was loaded %d times", page, count)
+		}
+	}
+
+	fake.set(func(f *fakeRadioCity) { f.Down["www.radiocity.in/"] = true })
+	if _, err := discoverPodcasts(context.Background(), radioCityURL+"/", existing, 3); err == nil {
+		t.Errorf("Expected discovery to fail without the landing page")
+	}
+	fake.set(func(f *fakeRadioCity) { f.Down["www.radiocity.in/"] = false })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := discoverPodcasts(ctx, radioCityURL+"/", existing, 3); err == nil {
+		t.Errorf("Expected a cancelled discovery to fail")
+	}
+}
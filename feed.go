@@ -5,38 +5,51 @@ import (
 	"encoding/xml"
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 )
 
 type RSS struct {
-	XMLName  xml.Name `xml:"rss"`
-	Version  string   `xml:"version,attr"`
-	AtomNS   string   `xml:"xmlns:atom,attr"`
-	ItunesNS string   `xml:"xmlns:itunes,attr"`
-	Channel  Channel
+	XMLName   xml.Name `xml:"rss"`
+	Version   string   `xml:"version,attr"`
+	AtomNS    string   `xml:"xmlns:atom,attr"`
+	ItunesNS  string   `xml:"xmlns:itunes,attr"`
+	PodcastNS string   `xml:"xmlns:podcast,attr,omitempty"`
+	Channel   Channel
 }
 
 func NewRSS() RSS {
 	return RSS{
-		Version:  "2.0",
-		AtomNS:   "http://www.w3.org/2005/Atom",
-		ItunesNS: "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Version:   "2.0",
+		AtomNS:    "http://www.w3.org/2005/Atom",
+		ItunesNS:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		PodcastNS: podcastNS,
 	}
 }
 
 type Channel struct {
-	XMLName       xml.Name `xml:"channel"`
-	AtomLink      AtomLink
-	Title         string  `xml:"title"`
-	Link          URL     `xml:"link"`
-	PublishDate   XMLDate `xml:"pubDate,omitempty"`
-	LastBuildDate XMLDate `xml:"lastBuildDate,omitempty"`
-	Description   string  `xml:"description"`
-	Image         Image
-	ItunesImage   ItunesImage
-	Items         []Item `xml:"item"`
+	XMLName          xml.Name `xml:"channel"`
+	AtomLink         AtomLink
+	HubLink          *HubLink
+	Title            string  `xml:"title"`
+	Link             URL     `xml:"link"`
+	PublishDate      XMLDate `xml:"pubDate,omitempty"`
+	LastBuildDate    XMLDate `xml:"lastBuildDate,omitempty"`
+	Description      string  `xml:"description"`
+	Language         string  `xml:"language,omitempty"`
+	Copyright        string  `xml:"copyright,omitempty"`
+	Image            Image
+	ItunesImage      ItunesImage
+	ItunesExplicit   string `xml:"itunes:explicit,omitempty"`
+	ItunesCategories []ItunesCategory
+	PodcastGUID      string `xml:"podcast:guid,omitempty"`
+	PodcastLocked    *PodcastLocked
+	PodcastLanguage  string `xml:"podcast:language,omitempty"`
+	Items            []Item `xml:"item"`
 }
 
 type Item struct {
@@ -48,6 +61,18 @@ type Item struct {
 	Enclosure   Enclosure
 	ItunesImage ItunesImage
 	Categories  []string `xml:"category"`
+	Source      *Source
+	// PodcastChapters and PodcastTranscripts come from the episodes in the
+	// config of the podcast
+	PodcastChapters    *PodcastChapters
+	PodcastTranscripts []PodcastTranscript
+}
+
+// Source names the podcast an item of a merged feed comes from
+type Source struct {
+	XMLName xml.Name `xml:"source"`
+	URL     URL      `xml:"url,attr"`
+	Name    string   `xml:",chardata"`
 }
 
 type GUID struct {
@@ -75,6 +100,76 @@ type ItunesImage struct {
 	URL     URL      `xml:"href,attr"`
 }
 
+type ItunesCategory struct {
+	XMLName xml.Name `xml:"itunes:category"`
+	Text    string   `xml:"text,attr"`
+}
+
+// languageCodes maps the languages named in the config to ISO 639 codes
+var languageCodes = map[string]string{
+	"bengali":   "bn",
+	"english":   "en",
+	"gujarati":  "gu",
+	"hindi":     "hi",
+	"kannada":   "kn",
+	"malayalam": "ml",
+	"marathi":   "mr",
+	"punjabi":   "pa",
+	"tamil":     "ta",
+	"telugu":    "te",
+}
+
+// languageCode is the ISO 639 code of a language in the config, codes are
+// passed through and unknown languages are left out
+func languageCode(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if code, ok := languageCodes[language]; ok {
+		return code
+	}
+	if len(language) == 2 || strings.Contains(language, "-") {
+		return language
+	}
+	return ""
+}
+
+// appleCategories maps config categories to Apple Podcasts categories
+var appleCategories = map[string]string{
+	"business":   "Business",
+	"comedy":     "Comedy",
+	"crime":      "True Crime",
+	"education":  "Education",
+	"fiction":    "Fiction",
+	"health":     "Health & Fitness",
+	"history":    "History",
+	"kids":       "Kids & Family",
+	"music":      "Music",
+	"news":       "News",
+	"religion":   "Religion & Spirituality",
+	"sports":     "Sports",
+	"technology": "Technology",
+}
+
+// itunesCategories lists the Apple Podcasts categories matching the config
+// categories, categories without a match are left out
+func itunesCategories(categories []string) []ItunesCategory {
+	var itunes []ItunesCategory
+	seen := make(map[string]bool)
+	for _, category := range categories {
+		text, ok := appleCategories[strings.ToLower(strings.TrimSpace(category))]
+		if !ok || seen[text] {
+			continue
+		}
+		seen[text] = true
+		itunes = append(itunes, ItunesCategory{Text: text})
+	}
+	return itunes
+}
+
+// explicitValue renders the itunes:explicit flag
+func explicitValue(explicit bool) string {
+	return strconv.FormatBool(explicit)
+}
+
 type AtomLink struct {
 	XMLName xml.Name `xml:"atom:link"`
 	URL     URL      `xml:"href,attr"`
@@ -82,8 +177,26 @@ type AtomLink struct {
 	Type    string   `xml:"type,attr"`
 }
 
+// isXMLChar reports whether the rune may appear in an xml document
+func isXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+// parseURL parses the link, rejecting links which could not be written to
+// a feed unchanged
 func parseURL(link string) (URL, error) {
 	var ur URL
+	if !utf8.ValidString(link) {
+		return ur, fmt.Errorf("%q is not valid utf-8", link)
+	}
+	for _, r := range link {
+		if !isXMLChar(r) {
+			return ur, fmt.Errorf("%q contains the character %U which is not allowed in xml", link, r)
+		}
+	}
 	u, err := url.Parse(link)
 	if err != nil {
 		return ur, err
@@ -94,7 +207,7 @@ func parseURL(link string) (URL, error) {
 func NewAtomLink(link string) AtomLink {
 	u, err := parseURL(link)
 	if err != nil {
-		fmt.Println("Failed to parse", link, err)
+		rootLogger.Warn("Failed to parse self link", "link", link, "err", err)
 	}
 	return AtomLink{
 		URL:  u,
@@ -103,6 +216,9 @@ func NewAtomLink(link string) AtomLink {
 	}
 }
 
+// now is the clock feed dates are taken from, tests freeze it
+var now = time.Now
+
 type XMLDate time.Time
 type URL url.URL
 
@@ -133,15 +249,7 @@ func (u *URL) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	if err != nil {
 		return errors.Wrapf(err, "Failed to parse %s as url", urlStr)
 	}
-	u.Scheme = ux.Scheme
-	u.Opaque = ux.Opaque
-	u.User = ux.User
-	u.Host = ux.Host
-	u.Path = ux.Path
-	u.RawPath = ux.RawPath
-	u.ForceQuery = ux.ForceQuery
-	u.RawQuery = ux.RawQuery
-	u.Fragment = ux.Fragment
+	*u = ux
 	return nil
 }
 
@@ -158,15 +266,7 @@ func (u *URL) UnmarshalXMLAttr(attr xml.Attr) error {
 	if err != nil {
 		return errors.Wrapf(err, "Failed to parse %s as url", attr.Value)
 	}
-	u.Scheme = ux.Scheme
-	u.Opaque = ux.Opaque
-	u.User = ux.User
-	u.Host = ux.Host
-	u.Path = ux.Path
-	u.RawPath = ux.RawPath
-	u.ForceQuery = ux.ForceQuery
-	u.RawQuery = ux.RawQuery
-	u.Fragment = ux.Fragment
+	*u = ux
 	return nil
 }
 
@@ -187,13 +287,15 @@ func (dd *XMLDate) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	return nil
 }
 
+// writeFeed encodes the feed as rss along with the podcast namespace tags
+// derived from the channel
 func writeFeed(rss RSS) (*bytes.Buffer, error) {
+	completePodcastTags(&rss.Channel)
 	out := bytes.NewBufferString(xml.Header)
 	enc := xml.NewEncoder(out)
 	enc.Indent("", "  ")
 	if err := enc.Encode(rss); err != nil {
-		fmt.Printf("error: %v\n", err)
-		return out, err
+		return out, errors.Wrap(err, "Failed to encode feed")
 	}
 	return out, nil
 }
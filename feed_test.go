@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -16,25 +17,6 @@ import (
 
 const configFile = "testdata/config.json"
 
-var configMap = map[string]string{
-	"/cd":  "testdata/cd.html",
-	"/kck": "testdata/kck.html",
-}
-
-func feedFromFile(podcast Podcast, file string) (RSS, error) {
-	rss := NewRSS()
-	buf, err := ioutil.ReadFile(file)
-	if err != nil {
-		return rss, errors.Wrapf(err, "Failed to read file %s", file)
-	}
-	selfLink := NewAtomLink("http://localhost:8080" + podcast.Path)
-	rss.Channel, err = getChannel(podcast, selfLink, buf)
-	if err != nil {
-		return rss, errors.Wrapf(err, "Failed to scrape channel from file")
-	}
-	return rss, nil
-}
-
 func loadPodcasts() ([]Podcast, error) {
 	podcasts := []Podcast{}
 	buf, err := ioutil.ReadFile(configFile)
@@ -47,16 +29,6 @@ func loadPodcasts() ([]Podcast, error) {
 	return podcasts, nil
 }
 
-func testBuilder(podcast Podcast) FeedBuilder {
-	htmlFile, ok := configMap[podcast.Path]
-	if !ok {
-		fmt.Printf("Failed to find htmlFile for %s\n", podcast.Path)
-	}
-	return func(podcast Podcast, selfLink AtomLink) (RSS, error) {
-		return feedFromFile(podcast, htmlFile)
-	}
-}
-
 func validateSelfLink(selfLink AtomLink, t *testing.T) {
 	if selfLink.URL.Scheme == "" {
 		t.Errorf("Channel must have a non-empty self link")
@@ -104,6 +76,9 @@ func validateItem(item Item, t *testing.T) {
 	if item.Enclosure.URL.Scheme == "" {
 		t.Errorf("Item enclosure must have a non-empty href")
 	}
+	if item.Enclosure.Length <= 0 {
+		t.Errorf("Item enclosure must have a known length")
+	}
 	if len(item.Categories) == 0 {
 		t.Errorf("Item must have atleast one category")
 	}
@@ -127,12 +102,9 @@ func TestFeed(t *testing.T) {
 	if len(podcasts) != 2 {
 		t.Fatalf("Expected to load 2 podcasts but, loaded %d", len(podcasts))
 	}
+	newFakeRadioCity(t)
 	podcast := podcasts[0]
-	htmlFile, ok := configMap[podcast.Path]
-	if !ok {
-		t.Fatalf("Test file not found for path %s", podcast.Path)
-	}
-	rss, err := feedFromFile(podcast, htmlFile)
+	rss, err := scrapeFeed(context.Background(), podcast, NewAtomLink("http://localhost:8080"+podcast.Path))
 	if err != nil {
 		t.Fatalf("Failed scrape podcast info\n%q", err)
 	}
@@ -176,7 +148,7 @@ func testPodcast(podcast Podcast, t *testing.T) func(*testing.T) {
 		url := "http://localhost:8080/" + podcast.Path
 		r := httptest.NewRequest("GET", url, nil)
 		w := httptest.NewRecorder()
-		RSSScrapeHandler(podcast, testBuilder(podcast))(w, r)
+		RSSScrapeHandler(podcast, scrapeFeed)(w, r)
 		res := w.Result()
 		if res.StatusCode != http.StatusOK {
 			t.Fatalf("Did not respond with success")
@@ -228,6 +200,7 @@ func TestRSS(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to load podcasts\n%q", err)
 	}
+	newFakeRadioCity(t)
 	for _, podcast := range podcasts {
 		t.Run(podcast.Name, testPodcast(podcast, t))
 	}
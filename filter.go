@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feedFilter narrows a feed down to the items matching the query
+// parameters of a feed request, such as ?category=crime&since=2018-10-01
+type feedFilter struct {
+	Categories []string
+	Since      time.Time
+	Limit      int
+	Query      string
+	Language   string
+}
+
+// parseFeedFilter reads the filter from the query parameters category,
+// since, limit, q and lang, other parameters are ignored
+func parseFeedFilter(values url.Values) (feedFilter, error) {
+	f := feedFilter{
+		Query:    strings.TrimSpace(values.Get("q")),
+		Language: strings.TrimSpace(values.Get("lang")),
+	}
+	for _, category := range values["category"] {
+		if category = strings.TrimSpace(category); category != "" {
+			f.Categories = append(f.Categories, category)
+		}
+	}
+	if since := values.Get("since"); since != "" {
+		d, err := time.ParseInLocation("2006-01-02", since, istLocation)
+		if err != nil {
+			return f, fmt.Errorf("since %q is not a date such as 2018-10-01", since)
+		}
+		f.Since = d
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return f, fmt.Errorf("limit %q is not a positive number", limit)
+		}
+		f.Limit = n
+	}
+	if f.Language != "" && languageCode(f.Language) == "" {
+		return f, fmt.Errorf("lang %q is not a known language", f.Language)
+	}
+	return f, nil
+}
+
+// empty reports whether the filter keeps every item
+func (f feedFilter) empty() bool {
+	return len(f.Categories) == 0 && f.Since.IsZero() && f.Limit == 0 && f.Query == "" && f.Language == ""
+}
+
+// values is the canonical query string of the filter, used for self links
+func (f feedFilter) values() url.Values {
+	values := url.Values{}
+	for _, category := range f.Categories {
+		values.Add("category", category)
+	}
+	if !f.Since.IsZero() {
+		values.Set("since", f.Since.Format("2006-01-02"))
+	}
+	if f.Limit > 0 {
+		values.Set("limit", strconv.Itoa(f.Limit))
+	}
+	if f.Query != "" {
+		values.Set("q", f.Query)
+	}
+	if f.Language != "" {
+		values.Set("lang", f.Language)
+	}
+	return values
+}
+
+// link is the feed url with the canonical query string of the filter
+func (f feedFilter) link(feedURL string) string {
+	if f.empty() {
+		return feedURL
+	}
+	return feedURL + "?" + f.values().Encode()
+}
+
+// describe summarises the filter for the channel title
+func (f feedFilter) describe() string {
+	var parts []string
+	if len(f.Categories) > 0 {
+		parts = append(parts, strings.Join(f.Categories, " or "))
+	}
+	if f.Language != "" {
+		parts = append(parts, f.Language)
+	}
+	if f.Query != "" {
+		parts = append(parts, fmt.Sprintf("matching %q", f.Query))
+	}
+	if !f.Since.IsZero() {
+		parts = append(parts, "since "+f.Since.Format("January 2, 2006"))
+	}
+	if f.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("latest %d", f.Limit))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matchesPodcast reports whether the items of the podcast can match the
+// filter, only the language is known before the podcast is scraped
+func (f feedFilter) matchesPodcast(podcast Podcast) bool {
+	return f.Language == "" || languageCode(f.Language) == languageCode(podcast.Language)
+}
+
+// podcasts keeps the podcasts whose items can match the filter
+func (f feedFilter) podcasts(podcasts []Podcast) []Podcast {
+	var matched []Podcast
+	for _, podcast := range podcasts {
+		if f.matchesPodcast(podcast) {
+			matched = append(matched, podcast)
+		}
+	}
+	return matched
+}
+
+// matchesItem reports whether the item matches the category, date and
+// search terms of the filter. Every search term has to appear in the
+// title or the description.
+func (f feedFilter) matchesItem(item Item) bool {
+	if len(f.Categories) > 0 {
+		found := false
+		for _, want := range f.Categories {
+			for _, category := range item.Categories {
+				if strings.EqualFold(want, category) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && time.Time(item.PublishDate).Before(f.Since) {
+		return false
+	}
+	text := strings.ToLower(item.Title + "\n" + item.Description)
+	for _, term := range strings.Fields(strings.ToLower(f.Query)) {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply keeps the matching items of the channel, newest first, and names
+// the channel after the filter. The language is matched on the podcasts
+// before they are scraped, see matchesPodcast.
+func (f feedFilter) apply(channel *Channel) {
+	if f.empty() {
+		return
+	}
+	var items []Item
+	for _, item := range channel.Items {
+		if f.matchesItem(item) {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return time.Time(items[i].PublishDate).After(time.Time(items[j].PublishDate))
+	})
+	if f.Limit > 0 && len(items) > f.Limit {
+		items = items[:f.Limit]
+	}
+	channel.Items = items
+	channel.Title = fmt.Sprintf("%s (%s)", channel.Title, f.describe())
+	channel.Image.Title = channel.Title
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFeedFilter(t *testing.T) {
+	values, _ := url.ParseQuery("utm_source=x&limit=5&since=2018-10-01&category=crime&q=+murder+&lang=tamil")
+	f, err := parseFeedFilter(values)
+	if err != nil {
+		t.Fatalf("Failed to parse filter\n%q", err)
+	}
+	if got := f.link("https://feeds.example.com/cd"); got != "https://feeds.example.com/cd?category=crime&lang=tamil&limit=5&q=murder&since=2018-10-01" {
+		t.Errorf("Unexpected self link %s", got)
+	}
+	if got := f.describe(); got != `crime, tamil, matching "murder", since October 1, 2018, latest 5` {
+		t.Errorf("Unexpected description %s", got)
+	}
+	for _, query := range []string{"limit=0", "limit=all", "since=01/10/2018", "lang=klingon"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseFeedFilter(values); err == nil {
+			t.Errorf("Expected %s to be rejected", query)
+		}
+	}
+}
+
+func TestFilteredFeed(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	fake := newFakeRadioCity(t)
+	mux := newServeMux(Config{Podcasts: podcasts}, scrapeFeed, buildFeed)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/master?lang=hindi&since=2018-10-20&limit=3&ref=x", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but was %d", w.Code)
+	}
+	var rss RSS
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("Failed to unmarshal feed xml\n%q", err)
+	}
+	if want := "RadioCity Master Feed (hindi, since October 20, 2018, latest 3)"; rss.Channel.Title != want {
+		t.Errorf("Expected title %q but was %q", want, rss.Channel.Title)
+	}
+	if !strings.Contains(w.Body.String(), `href="http://localhost:8080/master?lang=hindi&amp;limit=3&amp;since=2018-10-20"`) {
+		t.Errorf("Expected a self link with the canonical filter")
+	}
+	if len(rss.Channel.Items) != 3 {
+		t.Fatalf("Expected 3 items but was %d", len(rss.Channel.Items))
+	}
+	for i, item := range rss.Channel.Items {
+		if !strings.HasPrefix(item.Title, "Kissa Crime Ka") {
+			t.Errorf("Expected only hindi episodes but found %s", item.Title)
+		}
+		if i > 0 && time.Time(item.PublishDate).After(time.Time(rss.Channel.Items[i-1].PublishDate)) {
+			t.Errorf("Expected the newest episodes first")
+		}
+	}
+	for _, request := range fake.Requests() {
+		if strings.Contains(request, "Crime-Diary") {
+			t.Errorf("Expected the tamil podcast not to be scraped but requested %s", request)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/cd?q=EP+38", nil))
+	rss = RSS{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("Failed to unmarshal feed xml\n%q", err)
+	}
+	if len(rss.Channel.Items) != 1 || rss.Channel.Items[0].Title != "Crime Diary EP 38" {
+		t.Errorf("Expected only episode 38 to match but found %d items", len(rss.Channel.Items))
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/cd?lang=hindi", nil))
+	rss = RSS{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("Failed to unmarshal feed xml\n%q", err)
+	}
+	if len(rss.Channel.Items) != 0 {
+		t.Errorf("Expected no hindi episodes in the tamil podcast but found %d", len(rss.Channel.Items))
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/cd?limit=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid filter to be a bad request but was %d", w.Code)
+	}
+}
+
+func TestFilteredMasterLanguage(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	mux := newServeMux(Config{Podcasts: podcasts, Master: &MasterFeed{Language: "tamil"}}, scrapeFeed, buildFeed)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/master?lang=hindi", nil))
+	var rss RSS
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("Failed to unmarshal feed xml\n%q", err)
+	}
+	if len(rss.Channel.Items) == 0 {
+		t.Fatalf("Expected the hindi episodes of a master feed in another language")
+	}
+	for _, item := range rss.Channel.Items {
+		if !strings.HasPrefix(item.Title, "Kissa Crime Ka") {
+			t.Errorf("Expected only hindi episodes but found %s", item.Title)
+		}
+	}
+}
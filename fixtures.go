@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// manifestFile lists the recorded responses of a fixture directory
+const manifestFile = "fixtures.json"
+
+// recordedHeaders are the response headers kept in fixtures
+var recordedHeaders = []string{"Content-Type", "Content-Length", "Last-Modified", "Etag"}
+
+// fixtureEntry is a recorded response, the body of GET responses is
+// saved to File relative to the fixture directory
+type fixtureEntry struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	File       string      `json:"file,omitempty"`
+	RecordedAt time.Time   `json:"recordedAt"`
+}
+
+func (e fixtureEntry) key() string {
+	return e.Method + " " + e.URL
+}
+
+type fixtureManifest struct {
+	Entries []fixtureEntry `json:"entries"`
+}
+
+func readManifest(dir string) (fixtureManifest, error) {
+	var manifest fixtureManifest
+	buf, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return manifest, errors.Wrapf(err, "Failed to parse %s", filepath.Join(dir, manifestFile))
+	}
+	return manifest, nil
+}
+
+// fixtureFile names the file the body of a response is saved to, urls
+// differing only in their query get a short hash of it in the name
+func fixtureFile(u *url.URL, contentType string) string {
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		name = "index"
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, name)
+	if u.RawQuery != "" {
+		ext := path.Ext(name)
+		sum := sha256.Sum256([]byte(u.RawQuery))
+		name = strings.TrimSuffix(name, ext) + "-" + hex.EncodeToString(sum[:4]) + ext
+	}
+	if path.Ext(name) == "" && strings.HasPrefix(contentType, "text/html") {
+		name += ".html"
+	}
+	return path.Join(u.Host, name)
+}
+
+// recordingTransport passes requests on to the live site and records the
+// responses into a fixture directory
+type recordingTransport struct {
+	base http.RoundTripper
+	dir  string
+
+	mu      sync.Mutex
+	entries map[string]fixtureEntry
+}
+
+// newRecordingTransport records into dir keeping the responses already
+// recorded there
+func newRecordingTransport(base http.RoundTripper, dir string) (*recordingTransport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &recordingTransport{base: base, dir: dir, entries: make(map[string]fixtureEntry)}
+	manifest, err := readManifest(dir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return t, err
+	}
+	for _, entry := range manifest.Entries {
+		t.entries[entry.key()] = entry
+	}
+	return t, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	entry := fixtureEntry{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Status:     res.StatusCode,
+		Header:     http.Header{},
+		RecordedAt: time.Now().UTC(),
+	}
+	for _, name := range recordedHeaders {
+		if value := res.Header.Get(name); value != "" {
+			entry.Header.Set(name, value)
+		}
+	}
+	if req.Method == http.MethodGet {
+		buf, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to record %s", entry.URL)
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		entry.File = fixtureFile(req.URL, res.Header.Get("Content-Type"))
+		file := filepath.Join(t.dir, filepath.FromSlash(entry.File))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return nil, errors.Wrapf(err, "Failed to create fixture directory for %s", entry.URL)
+		}
+		if _, err := writeIfChanged(file, buf); err != nil {
+			return nil, err
+		}
+	}
+	t.mu.Lock()
+	t.entries[entry.key()] = entry
+	t.mu.Unlock()
+	return res, nil
+}
+
+// Save writes the manifest of every recorded response
+func (t *recordingTransport) Save() error {
+	t.mu.Lock()
+	manifest := fixtureManifest{}
+	for _, entry := range t.entries {
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	t.mu.Unlock()
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].key() < manifest.Entries[j].key()
+	})
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode fixture manifest")
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create fixture directory %s", t.dir)
+	}
+	_, err = writeIfChanged(filepath.Join(t.dir, manifestFile), append(buf, '\n'))
+	return err
+}
+
+// replayTransport answers requests with the responses recorded in a
+// fixture directory, requests which were never recorded fail
+type replayTransport struct {
+	dir     string
+	entries map[string]fixtureEntry
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read fixtures from %s", dir)
+	}
+	t := &replayTransport{dir: dir, entries: make(map[string]fixtureEntry)}
+	for _, entry := range manifest.Entries {
+		t.entries[entry.key()] = entry
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	entry, ok := t.entries[req.Method+" "+req.URL.String()]
+	if !ok {
+		return nil, fmt.Errorf("No recorded response for %s %s", req.Method, req.URL.String())
+	}
+	var body []byte
+	if entry.File != "" {
+		buf, err := ioutil.ReadFile(filepath.Join(t.dir, filepath.FromSlash(entry.File)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read recorded response for %s", entry.URL)
+		}
+		body = buf
+	}
+	header := http.Header{}
+	for name, values := range entry.Header {
+		header[name] = append([]string{}, values...)
+	}
+	contentLength := int64(len(body))
+	if entry.File == "" {
+		contentLength = -1
+		if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
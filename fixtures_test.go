@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	podcast := podcasts[0]
+	selfLink := NewAtomLink("http://localhost:8080" + podcast.Path)
+	dir := t.TempDir()
+	saved := httpClient.Transport
+	defer func() { httpClient.Transport = saved }()
+
+	newFakeRadioCity(t)
+	recorder, err := newRecordingTransport(httpClient.Transport, dir)
+	if err != nil {
+		t.Fatalf("Failed to create recorder\n%q", err)
+	}
+	httpClient.Transport = recorder
+	live, err := scrapeFeed(context.Background(), podcast, selfLink)
+	if err != nil {
+		t.Fatalf("Failed to scrape while recording\n%q", err)
+	}
+	if err := recorder.Save(); err != nil {
+		t.Fatalf("Failed to save fixtures\n%q", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "www.radiocity.in", "radiocity_show-podcasts-tamil_Crime-Diary_153.html")); err != nil {
+		t.Errorf("Expected the show page to be recorded\n%q", err)
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("Failed to read manifest\n%q", err)
+	}
+	if len(manifest.Entries) != len(live.Channel.Items)+1 {
+		t.Errorf("Expected the page and %d media headers to be recorded but found %d entries", len(live.Channel.Items), len(manifest.Entries))
+	}
+
+	replay, err := newReplayTransport(dir)
+	if err != nil {
+		t.Fatalf("Failed to load fixtures\n%q", err)
+	}
+	httpClient.Transport = replay
+	replayed, err := scrapeFeed(context.Background(), podcast, selfLink)
+	if err != nil {
+		t.Fatalf("Failed to scrape from fixtures\n%q", err)
+	}
+	if !reflect.DeepEqual(live.Channel.Items, replayed.Channel.Items) {
+		t.Errorf("Expected replayed items to match the recorded ones")
+	}
+	if _, err := loadUrl(context.Background(), "https://www.radiocity.in/unknown"); err == nil {
+		t.Errorf("Expected a request which was not recorded to fail")
+	}
+	res, err := headUrl(context.Background(), replayed.Channel.Items[0].Link.String())
+	if err != nil || res.StatusCode != http.StatusOK || res.Header.Get("Content-Length") == "" {
+		t.Errorf("Expected the recorded media headers to be replayed")
+	}
+}
+
+func TestFixtureFile(t *testing.T) {
+	tests := []struct {
+		url, contentType, file string
+	}{
+		{"https://www.radiocity.in/", "text/html", "www.radiocity.in/index.html"},
+		{"https://www.radiocity.in/radiocity/show-podcasts", "text/html; charset=utf-8", "www.radiocity.in/radiocity_show-podcasts.html"},
+		{"https://www.radiocity.in/radiocity/show-podcasts?page=2", "text/html", "www.radiocity.in/radiocity_show-podcasts-bc7c7eb0.html"},
+		{"https://media.radiocity.in/ep1.mp3?token=a", "audio/mpeg", "media.radiocity.in/ep1-3ff2ea18.mp3"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("Failed to parse %s\n%q", test.url, err)
+		}
+		if file := fixtureFile(u, test.contentType); file != test.file {
+			t.Errorf("Expected %s to be saved to %s but was %s", test.url, test.file, file)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+)
+
+func FuzzSplitPodName(f *testing.F) {
+	for _, seed := range []string{
+		"Crime Diary EP 38 -  Investigation on Mariappan`s Murder case - October 29, 2018",
+		"Crime-Diary EP 33 - Investigation of Rajve Man Power Solutions Owner Murder case - August 13, 2018",
+		"Crime Diary EP 29 -  Investigation on intelligence wing inspector Michale`s murder - July-27 - Part 02 - July 27, 2018",
+		"Kissa Crime Ka",
+		"- October 29, 2018",
+		" - - ",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		title, desc, date, ok := splitPodName(name)
+		if title != strings.TrimSpace(title) || desc != strings.TrimSpace(desc) {
+			t.Errorf("Expected title %q and description %q to be trimmed", title, desc)
+		}
+		if strings.TrimFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '-' }) != "" && (title == "" || desc == "") {
+			t.Errorf("Expected a title and description for %q but got %q and %q", name, title, desc)
+		}
+		if ok && (date.Year() < 0 || date.Year() > 9999) {
+			t.Errorf("Unexpected date %s parsed from %q", date, name)
+		}
+		if !ok && !date.IsZero() {
+			t.Errorf("Expected no date for %q but got %s", name, date)
+		}
+	})
+}
+
+func FuzzParseURL(f *testing.F) {
+	for _, seed := range []string{
+		"https://www.radiocity.in//images/other-channels/other-podcast/CrimeDiary Podcast40kb1493819764.jpg",
+		"https://prc.listenon.in/odm/podcasts/kck-25nov18.mp3",
+		"//www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153",
+		"http://localhost:8080/cd?category=crime#top",
+		"mailto:someone@example.com",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, link string) {
+		u, err := parseURL(link)
+		if err != nil {
+			return
+		}
+		first := u.String()
+		v, err := parseURL(first)
+		if err != nil {
+			t.Fatalf("Failed to parse %q rendered from %q\n%q", first, link, err)
+		}
+		if v.String() != first {
+			t.Errorf("Expected %q to render as itself but was %q", first, v.String())
+		}
+		buf, err := xml.Marshal(Enclosure{URL: u})
+		if err != nil {
+			t.Fatalf("Failed to marshal %q\n%q", first, err)
+		}
+		var enc Enclosure
+		if err := xml.Unmarshal(buf, &enc); err != nil {
+			t.Fatalf("Failed to unmarshal %s\n%q", buf, err)
+		}
+		if enc.URL.String() != first {
+			t.Errorf("Expected %q after an xml round trip but was %q", first, enc.URL.String())
+		}
+	})
+}
+
+func FuzzXMLDate(f *testing.F) {
+	f.Add(int64(1540751400), int16(330))
+	f.Add(int64(0), int16(0))
+	f.Add(int64(-62135596800), int16(-720))
+	f.Fuzz(func(t *testing.T, sec int64, offset int16) {
+		// RFC 1123 dates have four digit years and offsets within a day
+		const min, max = -62135596800, 253402300799
+		sec = min + (sec%(max-min)+(max-min))%(max-min)
+		zone := time.FixedZone("", int(offset)%(24*60)*60)
+		date := time.Unix(sec, 0).In(zone)
+		if date.Year() < 1 || date.Year() > 9999 {
+			return
+		}
+		buf, err := xml.Marshal(Item{PublishDate: XMLDate(date)})
+		if err != nil {
+			t.Fatalf("Failed to marshal %s\n%q", date, err)
+		}
+		var item Item
+		if err := xml.Unmarshal(buf, &item); err != nil {
+			t.Fatalf("Failed to unmarshal %s\n%q", buf, err)
+		}
+		if got := time.Time(item.PublishDate); !got.Equal(date) {
+			t.Errorf("Expected %s after an xml round trip but was %s", date, got)
+		}
+	})
+}
+
+func FuzzXMLDateUnmarshal(f *testing.F) {
+	f.Add("Mon, 29 Oct 2018 00:00:00 +0530")
+	f.Add("29 Oct 2018")
+	f.Fuzz(func(t *testing.T, value string) {
+		var b strings.Builder
+		if err := xml.EscapeText(&b, []byte(value)); err != nil {
+			return
+		}
+		var item Item
+		if err := xml.Unmarshal([]byte("<item><pubDate>"+b.String()+"</pubDate></item>"), &item); err != nil {
+			return
+		}
+		buf, err := xml.Marshal(item)
+		if err != nil {
+			t.Fatalf("Failed to marshal a parsed date %q\n%q", value, err)
+		}
+		var again Item
+		if err := xml.Unmarshal(buf, &again); err != nil {
+			t.Fatalf("Failed to unmarshal %s\n%q", buf, err)
+		}
+		if !time.Time(again.PublishDate).Equal(time.Time(item.PublishDate)) {
+			t.Errorf("Expected %s after an xml round trip but was %s", time.Time(item.PublishDate), time.Time(again.PublishDate))
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// frozenNow is the time the golden feeds are rendered at
+var frozenNow = time.Date(2018, time.December, 1, 10, 30, 0, 0, time.UTC)
+
+// freezeClock fixes the feed clock for the duration of the test
+func freezeClock(t *testing.T) {
+	saved := now
+	now = func() time.Time { return frozenNow }
+	t.Cleanup(func() { now = saved })
+}
+
+// checkGolden compares the output with the golden file, or replaces the
+// golden file when run with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", "golden", name)
+	if *update {
+		if _, err := writeIfChanged(file, got); err != nil {
+			t.Fatalf("Failed to update %s\n%q", file, err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s, run go test -update to create it\n%q", file, err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s does not match the rendered feed, run go test -update if the change is expected\n%s", file, lineDiff(string(want), string(got)))
+	}
+}
+
+// lineDiff lists the lines removed from (-) and added to (+) want with a
+// few lines of context around each change
+func lineDiff(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	type line struct {
+		op   byte
+		text string
+		num  int
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i], i + 1})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i], i + 1})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j], i + 1})
+			j++
+		}
+	}
+	const contextLines = 2
+	var out strings.Builder
+	last := -1
+	for k, l := range lines {
+		near := false
+		for d := k - contextLines; d <= k+contextLines; d++ {
+			if d >= 0 && d < len(lines) && lines[d].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last != k-1 {
+			fmt.Fprintf(&out, "@@ line %d @@\n", l.num)
+		}
+		fmt.Fprintf(&out, "%c %s\n", l.op, l.text)
+		last = k
+	}
+	return out.String()
+}
+
+// renderGolden writes the feed in every format for comparison
+func renderGolden(t *testing.T, name string, rss RSS) {
+	t.Helper()
+	selfLink := rss.Channel.AtomLink.URL.String()
+	out, err := writeFeed(rss)
+	if err != nil {
+		t.Fatalf("Failed to write feed\n%q", err)
+	}
+	checkGolden(t, name+".xml", out.Bytes())
+	out, err = writeAtom(rss, selfLink)
+	if err != nil {
+		t.Fatalf("Failed to write atom feed\n%q", err)
+	}
+	checkGolden(t, name+".atom", out.Bytes())
+	out, err = writeJSONFeed(rss, selfLink)
+	if err != nil {
+		t.Fatalf("Failed to write json feed\n%q", err)
+	}
+	checkGolden(t, name+".json", out.Bytes())
+}
+
+func TestGoldenFeeds(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	freezeClock(t)
+	ctx := context.Background()
+	for _, podcast := range podcasts {
+		t.Run(podcast.Name, func(t *testing.T) {
+			rss, err := scrapeFeed(ctx, podcast, NewAtomLink("http://localhost:8080"+podcast.Path))
+			if err != nil {
+				t.Fatalf("Failed to scrape %s\n%q", podcast.Name, err)
+			}
+			renderGolden(t, feedFile(podcast.Path, ""), rss)
+		})
+	}
+	t.Run("master", func(t *testing.T) {
+		rss, err := buildFeed(ctx, podcasts, NewAtomLink("http://localhost:8080/master"))
+		if err != nil {
+			t.Fatalf("Failed to build master feed\n%q", err)
+		}
+		renderGolden(t, "master", rss)
+	})
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := lineDiff("a\nb\nc\nd\ne\nf\ng", "a\nb\nc\nD\ne\nf\ng")
+	want := "@@ line 2 @@\n  b\n  c\n- d\n+ D\n  e\n  f\n"
+	if diff != want {
+		t.Errorf("Unexpected diff\n%s", diff)
+	}
+}
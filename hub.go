@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	hubRoute = "/hub"
+	// leases of subscriptions which do not ask for one and the bounds of
+	// those asked for
+	defaultLease = 10 * 24 * time.Hour
+	minLease     = time.Hour
+	maxLease     = 30 * 24 * time.Hour
+)
+
+// hubPollInterval is how often the feeds with subscribers are refreshed
+var hubPollInterval = 15 * time.Minute
+
+// hubClient verifies and notifies the subscribers, which are not radiocity
+var hubClient = &http.Client{Timeout: 30 * time.Second}
+
+// HubLink is the atom:link to the WebSub hub of a feed. It writes itself
+// as an atom:link because encoding/xml does not allow a second field with
+// the name of the self link.
+type HubLink struct {
+	URL URL
+}
+
+func (h HubLink) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{
+		Name: xml.Name{Local: "atom:link"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "href"}, Value: h.URL.String()},
+			{Name: xml.Name{Local: "rel"}, Value: "hub"},
+		},
+	}
+	return e.EncodeElement("", start)
+}
+
+// subscription is a verified WebSub subscription to a feed
+type subscription struct {
+	Topic    string
+	Callback string
+	Secret   string
+	Expires  time.Time
+}
+
+// websubHub is a WebSub hub for the feeds of the server. Subscriptions are
+// verified with the callback, the feeds with subscribers are refreshed
+// periodically and pushed to the subscribers when they have new items.
+type websubHub struct {
+	// accepts reports whether the path is a feed of the server
+	accepts func(path string) bool
+	// fetch requests the topic from the server so that it is observed
+	fetch func(ctx context.Context, topic string) error
+
+	start   sync.Once
+	pending sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[string]map[string]subscription
+	// seen holds the guids of the items last served for each topic with
+	// subscribers
+	seen map[string]map[string]bool
+}
+
+func newWebsubHub(accepts func(string) bool) *websubHub {
+	return &websubHub{
+		accepts: accepts,
+		subs:    make(map[string]map[string]subscription),
+		seen:    make(map[string]map[string]bool),
+	}
+}
+
+// topic is the canonical url of the feed, the self link the server gives
+// it, or an error when it is not a feed of the server
+func (h *websubHub) topic(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !h.accepts(u.Path) {
+		return "", fmt.Errorf("%q is not a feed of this hub", link)
+	}
+	filter, err := parseFeedFilter(u.Query())
+	if err != nil {
+		return "", err
+	}
+	return filter.link(u.Scheme + "://" + u.Host + u.Path), nil
+}
+
+// hubURL links the hub on the host of the feed
+func hubURL(selfLink AtomLink) URL {
+	u := url.URL(selfLink.URL)
+	return URL(*u.ResolveReference(&url.URL{Path: hubRoute}))
+}
+
+// feedBuilder links the hub from the feeds built by the builder
+func (h *websubHub) feedBuilder(builder FeedBuilder) FeedBuilder {
+	return func(ctx context.Context, podcast Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := builder(ctx, podcast, selfLink)
+		rss.Channel.HubLink = &HubLink{URL: hubURL(selfLink)}
+		return rss, err
+	}
+}
+
+// masterBuilder is feedBuilder for merged feeds
+func (h *websubHub) masterBuilder(master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := master(ctx, podcasts, selfLink)
+		rss.Channel.HubLink = &HubLink{URL: hubURL(selfLink)}
+		return rss, err
+	}
+}
+
+// ServeHTTP handles the subscribe, unsubscribe and publish requests. The
+// subscriptions are verified with the callback after responding.
+func (h *websubHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "WebSub requests must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("component", "hub")
+	mode := r.PostForm.Get("hub.mode")
+	switch mode {
+	case "subscribe", "unsubscribe":
+		sub, err := h.parseSubscription(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.background(func(ctx context.Context) {
+			if err := h.verify(ctx, mode, sub); err != nil {
+				logger.Warn("Failed to verify subscriber", "mode", mode, "topic", sub.Topic, "callback", sub.Callback, "err", err)
+			}
+		})
+	case "publish":
+		link := r.PostForm.Get("hub.url")
+		if link == "" {
+			link = r.PostForm.Get("hub.topic")
+		}
+		topic, err := h.topic(link)
+		if err != nil {
+			http.Error(w, "hub.url "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.background(func(ctx context.Context) {
+			if err := h.fetch(ctx, topic); err != nil {
+				logger.Warn("Failed to refresh published feed", "topic", topic, "err", err)
+			}
+		})
+	default:
+		http.Error(w, fmt.Sprintf("hub.mode %q is not subscribe, unsubscribe or publish", mode), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parseSubscription reads the subscription requested
+func (h *websubHub) parseSubscription(r *http.Request) (subscription, error) {
+	sub := subscription{Callback: r.PostForm.Get("hub.callback"), Secret: r.PostForm.Get("hub.secret")}
+	topic, err := h.topic(r.PostForm.Get("hub.topic"))
+	if err != nil {
+		return sub, errors.Wrap(err, "hub.topic")
+	}
+	sub.Topic = topic
+	if u, err := url.Parse(sub.Callback); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return sub, fmt.Errorf("hub.callback %q is not an http url", sub.Callback)
+	}
+	if len(sub.Secret) >= 200 {
+		return sub, fmt.Errorf("hub.secret must be shorter than 200 bytes")
+	}
+	lease := defaultLease
+	if seconds := r.PostForm.Get("hub.lease_seconds"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n < 1 {
+			return sub, fmt.Errorf("hub.lease_seconds %q is not a positive number", seconds)
+		}
+		lease = time.Duration(n) * time.Second
+	}
+	if lease < minLease {
+		lease = minLease
+	}
+	if lease > maxLease {
+		lease = maxLease
+	}
+	sub.Expires = now().Add(lease)
+	return sub, nil
+}
+
+// background runs the work after the request is answered
+func (h *websubHub) background(work func(ctx context.Context)) {
+	ctx := withLogger(context.Background(), rootLogger)
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		work(ctx)
+	}()
+}
+
+// verify asks the callback to confirm the subscription by echoing a
+// challenge, the subscription takes effect once it does
+func (h *websubHub) verify(ctx context.Context, mode string, sub subscription) error {
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	u, err := url.Parse(sub.Callback)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("hub.mode", mode)
+	query.Set("hub.topic", sub.Topic)
+	query.Set("hub.challenge", hex.EncodeToString(challenge))
+	if mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(int(sub.Expires.Sub(now())/time.Second)))
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := hubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 || strings.TrimSpace(string(body)) != query.Get("hub.challenge") {
+		return fmt.Errorf("callback responded with status %d and not the challenge", res.StatusCode)
+	}
+
+	h.mu.Lock()
+	if mode == "unsubscribe" {
+		delete(h.subs[sub.Topic], sub.Callback)
+		h.mu.Unlock()
+		loggerFrom(ctx).Info("Unsubscribed", "component", "hub", "topic", sub.Topic, "callback", sub.Callback)
+		return nil
+	}
+	if h.subs[sub.Topic] == nil {
+		h.subs[sub.Topic] = make(map[string]subscription)
+	}
+	h.subs[sub.Topic][sub.Callback] = sub
+	h.mu.Unlock()
+	loggerFrom(ctx).Info("Subscribed", "component", "hub", "topic", sub.Topic, "callback", sub.Callback, "expires", sub.Expires)
+	h.start.Do(func() { go h.run(context.Background()) })
+	// the first fetch records the items the subscriber already has
+	return h.fetch(ctx, sub.Topic)
+}
+
+// subscribers lists the subscriptions to the topic which have not expired
+func (h *websubHub) subscribers(topic string) []subscription {
+	var subs []subscription
+	for callback, sub := range h.subs[topic] {
+		if now().After(sub.Expires) {
+			delete(h.subs[topic], callback)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	if len(h.subs[topic]) == 0 {
+		delete(h.subs, topic)
+		delete(h.seen, topic)
+	}
+	return subs
+}
+
+// topics lists the topics with subscribers
+func (h *websubHub) topics() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var topics []string
+	for topic := range h.subs {
+		if len(h.subscribers(topic)) > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// run refreshes the feeds with subscribers at every poll interval
+func (h *websubHub) run(ctx context.Context) {
+	ticker := time.NewTicker(hubPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, topic := range h.topics() {
+			if err := h.fetch(withLogger(ctx, rootLogger), topic); err != nil {
+				rootLogger.Warn("Failed to refresh feed", "component", "hub", "topic", topic, "err", err)
+			}
+		}
+	}
+}
+
+// observe compares the items of the feed served for the topic with those
+// served before and pushes the feed to the subscribers when there are new
+// ones
+func (h *websubHub) observe(topic string, feed []byte, contentType string) {
+	var parsed struct {
+		Items []struct {
+			GUID string `xml:"guid"`
+		} `xml:"channel>item"`
+	}
+	if err := xml.Unmarshal(feed, &parsed); err != nil {
+		return
+	}
+	guids := make(map[string]bool)
+	for _, item := range parsed.Items {
+		guids[item.GUID] = true
+	}
+	h.mu.Lock()
+	subs := h.subscribers(topic)
+	if len(subs) == 0 {
+		h.mu.Unlock()
+		return
+	}
+	previous := h.seen[topic]
+	h.seen[topic] = guids
+	h.mu.Unlock()
+	if previous == nil {
+		return
+	}
+	added := 0
+	for guid := range guids {
+		if !previous[guid] {
+			added++
+		}
+	}
+	if added == 0 {
+		return
+	}
+	for _, sub := range subs {
+		sub := sub
+		h.background(func(ctx context.Context) {
+			h.distribute(ctx, sub, feed, contentType, added)
+		})
+	}
+}
+
+// distribute pushes the feed to the subscriber, signed with its secret.
+// Subscribers responding 410 Gone are unsubscribed.
+func (h *websubHub) distribute(ctx context.Context, sub subscription, feed []byte, contentType string, added int) {
+	logger := loggerFrom(ctx).With("component", "hub", "topic", sub.Topic, "callback", sub.Callback)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, bytes.NewReader(feed))
+	if err != nil {
+		logger.Warn("Failed to notify subscriber", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+	if topic, err := parseURL(sub.Topic); err == nil {
+		hub := hubURL(AtomLink{URL: topic})
+		req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hub.String()))
+	}
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, sub.Topic))
+	if sub.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write(feed)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := hubClient.Do(req)
+	if err != nil {
+		logger.Warn("Failed to notify subscriber", "err", err)
+		return
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusGone:
+		h.mu.Lock()
+		delete(h.subs[sub.Topic], sub.Callback)
+		h.mu.Unlock()
+		logger.Info("Subscriber is gone, unsubscribed")
+	case res.StatusCode/100 != 2:
+		logger.Warn("Subscriber rejected the notification", "status", res.StatusCode)
+	default:
+		logger.Info("Notified subscriber", "items", added)
+	}
+}
+
+// observing serves the feed and lets the hub observe the feed served
+func (h *websubHub) observing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if r.Method != http.MethodGet || rec.status != http.StatusOK {
+			return
+		}
+		filter, err := parseFeedFilter(r.URL.Query())
+		if err != nil {
+			return
+		}
+		h.observe(filter.link(requestBase(r)+r.URL.Path), rec.body.Bytes(), rec.Header().Get("Content-Type"))
+	})
+}
+
+// bodyRecorder keeps a copy of the status and body written
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(buf []byte) (int, error) {
+	r.body.Write(buf)
+	return r.ResponseWriter.Write(buf)
+}
+
+// discardResponse is the response of the requests the hub makes to the
+// server itself
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponse) Header() http.Header           { return d.header }
+func (d *discardResponse) Write(buf []byte) (int, error) { return len(buf), nil }
+func (d *discardResponse) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+// serverFetch requests the topic from the handler as a client of the
+// server would
+func serverFetch(handler http.Handler) func(context.Context, string) error {
+	return func(ctx context.Context, topic string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, topic, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
+		w := &discardResponse{header: make(http.Header)}
+		handler.ServeHTTP(w, req)
+		if w.status != 0 && w.status != http.StatusOK {
+			return fmt.Errorf("%s responded with status %d", topic, w.status)
+		}
+		return nil
+	}
+}
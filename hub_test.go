@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSubscriber is a WebSub subscriber which echoes the challenges and
+// records the notifications
+type fakeSubscriber struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	verified []string
+	pushed   []*http.Request
+	bodies   []string
+	// Refuse answers the verifications without the challenge
+	Refuse bool
+	// Gone answers the notifications with 410 Gone
+	Gone bool
+}
+
+func newFakeSubscriber(t *testing.T) *fakeSubscriber {
+	s := &fakeSubscriber{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Method == http.MethodGet {
+			if s.Refuse {
+				http.NotFound(w, r)
+				return
+			}
+			s.verified = append(s.verified, r.URL.Query().Get("hub.mode"))
+			w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.pushed = append(s.pushed, r)
+		s.bodies = append(s.bodies, string(body))
+		if s.Gone {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func testFeed(t *testing.T, guids ...string) []byte {
+	rss := NewRSS()
+	rss.Channel.Title = "Crime Diary"
+	for _, guid := range guids {
+		rss.Channel.Items = append(rss.Channel.Items, Item{Title: guid, GUID: GUID{Value: guid}})
+	}
+	out, err := writeFeed(rss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestWebsubHub(t *testing.T) {
+	const topic = "https://feeds.example.com/cd"
+	sub := newFakeSubscriber(t)
+	feed := testFeed(t, "ep1", "ep2")
+	hub := newWebsubHub(func(path string) bool { return path == "/cd" })
+	hub.fetch = func(ctx context.Context, topic string) error {
+		hub.observe(topic, feed, "application/rss+xml")
+		return nil
+	}
+	post := func(form url.Values) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, hubRoute, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		hub.ServeHTTP(w, r)
+		hub.pending.Wait()
+		return w.Code
+	}
+	subscribe := url.Values{
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {topic},
+		"hub.callback": {sub.server.URL + "/callback?feed=cd"},
+		"hub.secret":   {"s3cret"},
+	}
+
+	for _, form := range []url.Values{
+		{"hub.mode": {"subscribe"}, "hub.topic": {"https://feeds.example.com/nope"}, "hub.callback": {sub.server.URL}},
+		{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {"ftp://example.com/"}},
+		{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {sub.server.URL}, "hub.lease_seconds": {"soon"}},
+		{"hub.mode": {"watch"}, "hub.topic": {topic}},
+	} {
+		if code := post(form); code != http.StatusBadRequest {
+			t.Errorf("Expected %v to be a bad request but was %d", form, code)
+		}
+	}
+	w := httptest.NewRecorder()
+	hub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, hubRoute, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a GET to the hub to be refused but was %d", w.Code)
+	}
+
+	sub.Refuse = true
+	if code := post(subscribe); code != http.StatusAccepted {
+		t.Fatalf("Expected the subscription to be accepted but was %d", code)
+	}
+	if len(hub.topics()) != 0 {
+		t.Fatalf("Expected a subscriber which does not echo the challenge not to be subscribed")
+	}
+	sub.Refuse = false
+	if code := post(subscribe); code != http.StatusAccepted {
+		t.Fatalf("Expected the subscription to be accepted but was %d", code)
+	}
+	if topics := hub.topics(); len(topics) != 1 || topics[0] != topic || len(sub.verified) != 1 {
+		t.Fatalf("Expected the subscription to be verified but subscribed to %v", topics)
+	}
+
+	hub.observe(topic, feed, "application/rss+xml")
+	hub.pending.Wait()
+	if len(sub.pushed) != 0 {
+		t.Errorf("Expected an unchanged feed not to be pushed")
+	}
+	feed = testFeed(t, "ep3", "ep1", "ep2")
+	hub.observe(topic, feed, "application/rss+xml")
+	hub.pending.Wait()
+	if len(sub.pushed) != 1 {
+		t.Fatalf("Expected the feed with a new item to be pushed once but was pushed %d times", len(sub.pushed))
+	}
+	push := sub.pushed[0]
+	if push.URL.Query().Get("feed") != "cd" || sub.bodies[0] != string(feed) {
+		t.Errorf("Expected the new feed to be posted to the callback")
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(feed)
+	if got, want := push.Header.Get("X-Hub-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("Expected the signature %s but was %s", want, got)
+	}
+	links := strings.Join(push.Header["Link"], ", ")
+	if !strings.Contains(links, `<https://feeds.example.com/hub>; rel="hub"`) || !strings.Contains(links, `<`+topic+`>; rel="self"`) {
+		t.Errorf("Expected the hub and self links but were %s", links)
+	}
+
+	sub.Gone = true
+	hub.observe(topic, testFeed(t, "ep4", "ep3"), "application/rss+xml")
+	hub.pending.Wait()
+	if len(hub.topics()) != 0 {
+		t.Errorf("Expected a subscriber answering 410 to be unsubscribed")
+	}
+
+	sub.Gone = false
+	post(subscribe)
+	unsubscribe := url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {topic}, "hub.callback": subscribe["hub.callback"]}
+	if code := post(unsubscribe); code != http.StatusAccepted || len(hub.topics()) != 0 {
+		t.Errorf("Expected the subscriber to be unsubscribed")
+	}
+}
+
+func TestHubLink(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	mux := newServeMux(Config{Podcasts: podcasts, WebSub: true}, scrapeFeed, buildFeed)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://feeds.example.com/cd", nil))
+	if !strings.Contains(w.Body.String(), `<atom:link href="http://feeds.example.com/hub" rel="hub"></atom:link>`) {
+		t.Errorf("Expected the feed to link the hub")
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://feeds.example.com/hub", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected the hub to be served at /hub but was %d", w.Code)
+	}
+}
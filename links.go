@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+)
+
+// httpsHosts are known to serve the same content over https
+var httpsHosts = map[string]bool{
+	"radiocity.in":     true,
+	"www.radiocity.in": true,
+	"prc.listenon.in":  true,
+}
+
+// normalizeURL cleans up a scraped link. Relative links are resolved
+// against the base, repeated slashes in the path are collapsed, hosts
+// known to serve https are switched to it and the path is percent-encoded
+// when the url is written.
+func normalizeURL(link string, base *url.URL) (URL, error) {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return URL{}, fmt.Errorf("empty url")
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return URL{}, err
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme == "" && u.Host != "" {
+		u.Scheme = "https"
+	}
+	if u.Host == "" {
+		return URL{}, fmt.Errorf("%q is not an absolute url", link)
+	}
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "http" && httpsHosts[u.Hostname()] {
+		u.Scheme = "https"
+	}
+	for strings.Contains(u.Path, "//") {
+		u.Path = strings.Replace(u.Path, "//", "/", -1)
+	}
+	u.RawPath = ""
+	return parseURL(u.String())
+}
+
+// canonicalLink is the canonical link of a scraped page resolved against
+// radiocity, or the fallback when the page has none
+func canonicalLink(doc *goquery.Document, fallback string) (URL, error) {
+	link := doc.Find(`link[rel="canonical"]`).First().AttrOr("href", "")
+	if strings.TrimSpace(link) == "" {
+		link = fallback
+	}
+	base, _ := url.Parse(radioCityURL)
+	u, err := normalizeURL(link, base)
+	if err != nil {
+		return u, errors.Wrapf(err, "Failed to parse url %s", link)
+	}
+	return u, nil
+}
+
+// linkStatus is the outcome of checking a link of a feed
+type linkStatus struct {
+	URL       string    `json:"url"`
+	Kind      string    `json:"kind"`
+	Podcast   string    `json:"podcast"`
+	Item      string    `json:"item,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Dead      bool      `json:"dead"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+func (s linkStatus) String() string {
+	state := "ok"
+	if s.Dead {
+		state = "DEAD"
+	}
+	result := fmt.Sprint(s.Status)
+	if s.Error != "" {
+		result = s.Error
+	}
+	where := s.Podcast
+	if s.Item != "" {
+		where += fmt.Sprintf(" %q", s.Item)
+	}
+	return fmt.Sprintf("%-4s %-9s %s %s %s", state, s.Kind, where, s.URL, result)
+}
+
+// linkReport lists the links checked in one pass
+type linkReport struct {
+	CheckedAt time.Time    `json:"checkedAt"`
+	Checked   int          `json:"checked"`
+	Dead      int          `json:"dead"`
+	Links     []linkStatus `json:"links"`
+}
+
+// collectLinks scrapes the podcasts for the images and enclosures their
+// feeds link, each link is listed once. Podcasts which fail to scrape are
+// returned as errors.
+func collectLinks(ctx context.Context, podcasts []Podcast) ([]linkStatus, []error) {
+	var links []linkStatus
+	var errs []error
+	seen := make(map[string]bool)
+	add := func(u URL, kind string, podcast Podcast, item string) {
+		link := u.String()
+		if link == "" || seen[link] {
+			return
+		}
+		seen[link] = true
+		links = append(links, linkStatus{URL: link, Kind: kind, Podcast: podcast.Path, Item: item})
+	}
+	for _, podcast := range podcasts {
+		rss, err := scrapeFeed(ctx, podcast, NewAtomLink(podcast.Path))
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "Failed to scrape %s", podcast.Path))
+			continue
+		}
+		add(rss.Channel.Image.URL, "image", podcast, "")
+		add(rss.Channel.ItunesImage.URL, "image", podcast, "")
+		for _, item := range rss.Channel.Items {
+			add(item.Enclosure.URL, "enclosure", podcast, item.Title)
+			add(item.ItunesImage.URL, "image", podcast, item.Title)
+		}
+	}
+	return links, errs
+}
+
+// checkLink requests the headers of the link, servers which do not
+// support HEAD are asked for the first byte instead
+func checkLink(ctx context.Context, link string) (int, error) {
+	res, err := headUrl(ctx, link)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		return res.StatusCode, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	res, err = httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// checkLinks checks the links with a few workers, links which fail to
+// load or respond with an error status are dead
+func checkLinks(ctx context.Context, links []linkStatus, workers int) linkReport {
+	report := linkReport{CheckedAt: now(), Checked: len(links), Links: links}
+	in := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range in {
+				link := &links[i]
+				link.Status, link.Dead = 0, false
+				status, err := checkLink(ctx, link.URL)
+				link.CheckedAt = now()
+				if err != nil {
+					link.Error, link.Dead = err.Error(), true
+					continue
+				}
+				link.Status, link.Dead = status, status >= 400
+			}
+		}()
+	}
+	for i := range links {
+		in <- i
+	}
+	close(in)
+	wg.Wait()
+	for _, link := range links {
+		if link.Dead {
+			report.Dead++
+		}
+	}
+	return report
+}
+
+// linkChecker checks the links of every podcast periodically and serves
+// the latest report
+type linkChecker struct {
+	podcasts []Podcast
+	interval time.Duration
+	workers  int
+
+	mu     sync.Mutex
+	report linkReport
+}
+
+func newLinkChecker(podcasts []Podcast, interval time.Duration) *linkChecker {
+	return &linkChecker{podcasts: podcasts, interval: interval, workers: 4}
+}
+
+// check runs a single pass over the links
+func (c *linkChecker) check(ctx context.Context) linkReport {
+	logger := loggerFrom(ctx).With("component", "links")
+	start := time.Now()
+	links, errs := collectLinks(ctx, c.podcasts)
+	for _, err := range errs {
+		logger.Warn("Skipped links of podcast", "err", err)
+	}
+	report := checkLinks(ctx, links, c.workers)
+	for _, link := range report.Links {
+		if link.Dead {
+			logger.Warn("Dead link", "kind", link.Kind, "podcast", link.Podcast, "url", link.URL, "status", link.Status, "err", link.Error)
+		}
+	}
+	logger.Info("Checked links", "checked", report.Checked, "dead", report.Dead, "duration", time.Since(start))
+	c.mu.Lock()
+	c.report = report
+	c.mu.Unlock()
+	return report
+}
+
+// run checks the links right away and then at every interval until the
+// context is done
+func (c *linkChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeHTTP responds with the latest report as json, only the dead links
+// are listed with dead=true
+func (c *linkChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	report := c.report
+	c.mu.Unlock()
+	if dead, _ := strconv.ParseBool(r.URL.Query().Get("dead")); dead {
+		var links []linkStatus
+		for _, link := range report.Links {
+			if link.Dead {
+				links = append(links, link)
+			}
+		}
+		report.Links = links
+	}
+	if report.Links == nil {
+		report.Links = []linkStatus{}
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode link report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(buf, '\n'))
+}
+
+// runLinks implements the links command which checks the links once
+func runLinks(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("links", flag.ExitOnError)
+	all := fs.Bool("all", false, "list every link instead of only the dead ones")
+	workers := fs.Int("workers", 4, "number of links to check concurrently")
+	fs.Parse(args)
+	if *workers < 1 {
+		return fmt.Errorf("-workers %d is not a positive number", *workers)
+	}
+	checker := newLinkChecker(config.Podcasts, 0)
+	checker.workers = *workers
+	report := checker.check(ctx)
+	for _, link := range report.Links {
+		if *all || link.Dead {
+			fmt.Println(link)
+		}
+	}
+	fmt.Printf("%d links checked, %d dead\n", report.Checked, report.Dead)
+	if report.Dead > 0 {
+		return fmt.Errorf("Found %d dead links", report.Dead)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	base, _ := url.Parse("https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153")
+	for _, test := range []struct {
+		link string
+		base *url.URL
+		want string
+	}{
+		{"https://www.radiocity.in//images/Crime Diary.jpg", nil, "https://www.radiocity.in/images/Crime%20Diary.jpg"},
+		{"  http://prc.listenon.in/Podcast/EP 38.mp3 ", nil, "https://prc.listenon.in/Podcast/EP%2038.mp3"},
+		{"http://example.com/a.mp3", nil, "http://example.com/a.mp3"},
+		{"//WWW.radiocity.in/images/a.jpg", nil, "https://www.radiocity.in/images/a.jpg"},
+		{"/images/a.jpg", base, "https://www.radiocity.in/images/a.jpg"},
+		{"../Kissa-Crime-Ka/82", base, "https://www.radiocity.in/radiocity/show-podcasts-tamil/Kissa-Crime-Ka/82"},
+	} {
+		got, err := normalizeURL(test.link, test.base)
+		if err != nil {
+			t.Errorf("Failed to normalize %q\n%q", test.link, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("Expected %q to normalize to %s but was %s", test.link, test.want, got.String())
+		}
+	}
+	for _, link := range []string{"", "   ", "images/a.jpg"} {
+		if _, err := normalizeURL(link, nil); err == nil {
+			t.Errorf("Expected %q to fail to normalize", link)
+		}
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	fake := newFakeRadioCity(t)
+	ctx := context.Background()
+	links, errs := collectLinks(ctx, podcasts)
+	if len(errs) > 0 {
+		t.Fatalf("Failed to collect links\n%q", errs)
+	}
+	var enclosures []linkStatus
+	for _, link := range links {
+		if link.Kind == "enclosure" {
+			enclosures = append(enclosures, link)
+		}
+	}
+	if len(enclosures) < 2 {
+		t.Fatalf("Expected the enclosures of every podcast but found %d", len(enclosures))
+	}
+	missing, _ := url.Parse(enclosures[0].URL)
+	down, _ := url.Parse(enclosures[1].URL)
+	fake.set(func(f *fakeRadioCity) {
+		f.Status[missing.Host+missing.Path] = http.StatusNotFound
+		f.Down[down.Host+down.Path] = true
+	})
+
+	checker := newLinkChecker(podcasts, 0)
+	report := checker.check(ctx)
+	if report.Checked != len(links) || report.Dead != 2 {
+		t.Fatalf("Expected 2 of %d links dead but %d of %d were", len(links), report.Dead, report.Checked)
+	}
+	dead := make(map[string]linkStatus)
+	for _, link := range report.Links {
+		if link.Dead {
+			dead[link.URL] = link
+		}
+	}
+	if link := dead[enclosures[0].URL]; link.Status != http.StatusNotFound {
+		t.Errorf("Expected %s to be dead with status 404 but was %v", enclosures[0].URL, link)
+	}
+	if link := dead[enclosures[1].URL]; link.Error == "" {
+		t.Errorf("Expected %s to be dead with an error but was %v", enclosures[1].URL, link)
+	}
+
+	w := httptest.NewRecorder()
+	checker.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status?dead=true", nil))
+	var served linkReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Failed to parse the status\n%q", err)
+	}
+	if served.Checked != len(links) || served.Dead != 2 || len(served.Links) != 2 {
+		t.Errorf("Expected only the 2 dead links to be listed but listed %d", len(served.Links))
+	}
+}
+
+func TestRunLinksWorkers(t *testing.T) {
+	for _, workers := range []string{"0", "-1"} {
+		if err := runLinks(context.Background(), Config{}, []string{"-workers", workers}); err == nil {
+			t.Errorf("Expected -workers %s to be rejected", workers)
+		}
+	}
+}
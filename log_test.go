@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LevelInfo, FormatLogfmt)
+	if err != nil {
+		t.Fatalf("Failed to create logger\n%q", err)
+	}
+	logger = logger.With("podcast", "/cd")
+	logger.Debug("hidden")
+	logger.Info("Loaded page", "name", "Crime Diary", "err", errors.New("boom"))
+	line := buf.String()
+	if strings.Contains(line, "hidden") {
+		t.Errorf("Debug record should not be logged at info level")
+	}
+	for _, want := range []string{`level=info`, `msg="Loaded page"`, `podcast=/cd`, `name="Crime Diary"`, `err=boom`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected %s in %s", want, line)
+		}
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LevelDebug, FormatJSON)
+	if err != nil {
+		t.Fatalf("Failed to create logger\n%q", err)
+	}
+	logger.Warn("Failed", "status", 404)
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Failed to parse json log record %s\n%q", buf.String(), err)
+	}
+	if rec["level"] != "warn" || rec["msg"] != "Failed" || rec["status"] != float64(404) {
+		t.Errorf("Unexpected log record %v", rec)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := NewLogger(&buf, LevelInfo, FormatLogfmt)
+	saved := rootLogger
+	rootLogger = logger
+	defer func() { rootLogger = saved }()
+
+	var seen string
+	handler := withRequestLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+		loggerFrom(r.Context()).Info("inner")
+	}))
+	r := httptest.NewRequest("GET", "http://localhost:8080/cd", nil)
+	r.Header.Set("X-Request-Id", "abc123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if seen != "abc123" {
+		t.Errorf("Expected request id abc123 but was %s", seen)
+	}
+	if w.Header().Get("X-Request-Id") != "abc123" {
+		t.Errorf("Expected request id to be echoed in the response")
+	}
+	if strings.Count(buf.String(), "request_id=abc123") != 2 {
+		t.Errorf("Expected both records to carry the request id\n%s", buf.String())
+	}
+	if requestIDFrom(context.Background()) != "" {
+		t.Errorf("Expected no request id without a request")
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -13,6 +16,19 @@ type Podcast struct {
 	URL        string   `json:"url"`
 	Image      string   `json:"imageUrl"`
 	Categories []string `json:"categories"`
+	Language   string   `json:"language,omitempty"`
+	Explicit   bool     `json:"explicit,omitempty"`
+	// GUID is the podcast:guid of the feed, derived from the feed url when
+	// empty. Set it to keep the guid when the feed moves.
+	GUID string `json:"guid,omitempty"`
+	// Locked asks other platforms not to import the feed, Owner is the
+	// email allowed to unlock it
+	Locked   bool      `json:"locked,omitempty"`
+	Owner    string    `json:"owner,omitempty"`
+	Episodes []Episode `json:"episodes,omitempty"`
+	// Refresh is the interval the podcast is scraped at in the background,
+	// eg. "6h", overriding the one of the refresh config
+	Refresh string `json:"refresh,omitempty"`
 }
 
 var podcasts = []Podcast{
@@ -22,6 +38,7 @@ var podcasts = []Podcast{
 		URL:        "https://www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153",
 		Image:      "https://www.radiocity.in//images/other-channels/other-podcast/CrimeDiary Podcast40kb1493819764.jpg",
 		Categories: []string{"crime", "podcast"},
+		Language:   "tamil",
 	},
 	Podcast{
 		Path:       "/kck",
@@ -29,54 +46,243 @@ var podcasts = []Podcast{
 		URL:        "https://www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82",
 		Image:      "https://www.radiocity.in//images/other-channels/other-podcast/kisacrimeka1490279213.jpg",
 		Categories: []string{"crime", "podcast"},
+		Language:   "hindi",
 	},
 }
 
-func buildFeed(podcasts []Podcast, selfLink AtomLink) (RSS, error) {
-	logger := log.New(os.Stderr, "[main][buildFeed ", 0)
-	start := time.Now()
+// scrapeFeed builds the feed of a single podcast by scraping its page
+func scrapeFeed(ctx context.Context, podcast Podcast, selfLink AtomLink) (RSS, error) {
 	rss := NewRSS()
-	masterImage := "https://www.radiocity.in/images/menu-images/logo.png"
+	channel, err := scrapeChannel(ctx, podcast, selfLink)
+	if err != nil {
+		return rss, err
+	}
+	rss.Channel = channel
+	return rss, nil
+}
+
+// Defaults of the master feed metadata, see MasterFeed
+const (
+	masterTitle       = "RadioCity Master Feed"
+	masterDescription = "Generated master feed from a given set of podcasts"
+	masterImage       = "https://www.radiocity.in/images/menu-images/logo.png"
+)
+
+// masterChannel describes the master feed without any items, linking the
+// feed itself
+func masterChannel(ctx context.Context, selfLink AtomLink) Channel {
 	imgUrl, err := parseURL(masterImage)
 	if err != nil {
-		fmt.Printf("Failed to parse image url %s", masterImage)
+		loggerFrom(ctx).Warn("Failed to parse image url", "url", masterImage, "err", err)
 	}
-	rss.Channel = Channel{
+	return Channel{
 		AtomLink:      selfLink,
-		Title:         "RadioCity Master Feed",
+		Title:         masterTitle,
 		Link:          selfLink.URL,
-		PublishDate:   XMLDate(time.Now()),
-		LastBuildDate: XMLDate(time.Now()),
-		Description:   "Generated master feed from a given set of podcasts",
+		PublishDate:   XMLDate(now()),
+		LastBuildDate: XMLDate(now()),
+		Description:   masterDescription,
 		Image: Image{
-			Link:  imgUrl,
-			Title: "RadioCity Master Feed",
-			URL:   selfLink.URL,
+			Link:  selfLink.URL,
+			Title: masterTitle,
+			URL:   imgUrl,
 		},
 		ItunesImage: ItunesImage{
 			URL: imgUrl,
 		},
 	}
+}
+
+// describeMembers flags a merged channel as explicit when any of its
+// podcasts is and lists the categories of all of them
+func describeMembers(channel *Channel, podcasts []Podcast) {
+	var categories []string
+	explicit := false
+	for _, podcast := range podcasts {
+		categories = append(categories, podcast.Categories...)
+		explicit = explicit || podcast.Explicit
+	}
+	channel.ItunesExplicit = explicitValue(explicit)
+	channel.ItunesCategories = itunesCategories(categories)
+}
+
+func buildFeed(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+	logger := loggerFrom(ctx).With("component", "master")
+	start := time.Now()
+	rss := NewRSS()
+	rss.Channel = masterChannel(ctx, selfLink)
 	for _, podcast := range podcasts {
-		pitems, err := scrapeItems(podcast)
+		pitems, err := scrapeItems(ctx, podcast)
 		if err != nil {
 			return rss, err
 		}
+		tagSource(pitems, podcast, sourceURL(selfLink, podcast))
 		rss.Channel.Items = append(rss.Channel.Items, pitems...)
 	}
-	logger.Printf("Built master feed in %s", time.Since(start).String())
+	rss.Channel.Items = mergeItems(rss.Channel.Items)
+	if latest := latestDate(rss.Channel.Items); !latest.IsZero() {
+		rss.Channel.PublishDate = XMLDate(latest)
+	}
+	describeMembers(&rss.Channel, podcasts)
+	logger.Info("Built master feed", "items", len(rss.Channel.Items), "duration", time.Since(start))
 	return rss, nil
 
 }
+
+// fatal logs the error and exits, keeping stdout free of anything but feeds
+func fatal(msg string, err error) {
+	rootLogger.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// findFeed returns the builder for the podcast or composite feed with the
+// prefix, the empty prefix and master select the master feed
+func findFeed(config Config, prefix string) (func(context.Context, AtomLink) (RSS, error), string, error) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" || prefix == "/master" {
+		build := masterBuilder(config.master(), buildFeed)
+		return func(ctx context.Context, selfLink AtomLink) (RSS, error) {
+			return build(ctx, config.Podcasts, selfLink)
+		}, "/master", nil
+	}
+	for _, podcast := range config.Podcasts {
+		if podcast.Path == prefix {
+			podcast := podcast
+			return func(ctx context.Context, selfLink AtomLink) (RSS, error) {
+				return scrapeFeed(ctx, podcast, selfLink)
+			}, prefix, nil
+		}
+	}
+	if feed, ok := findComposite(config.Feeds, prefix); ok {
+		build := compositeBuilder(feed, buildFeed)
+		return func(ctx context.Context, selfLink AtomLink) (RSS, error) {
+			return build(ctx, config.Podcasts, selfLink)
+		}, prefix, nil
+	}
+	return nil, prefix, fmt.Errorf("No podcast or feed configured with prefix %s", prefix)
+}
+
+// runFetch implements the fetch command which prints a single feed
+func runFetch(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	format := fs.String("format", "rss", "feed format to print (rss, atom, json)")
+	record := fs.String("record", "", "record the pages and media headers loaded into this fixture directory")
+	fs.Parse(args)
+	build, prefix, err := findFeed(config, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *record != "" {
+		recorder, err := newRecordingTransport(httpClient.Transport, *record)
+		if err != nil {
+			return err
+		}
+		saved := httpClient.Transport
+		httpClient.Transport = recorder
+		defer func() { httpClient.Transport = saved }()
+		defer func() {
+			if err := recorder.Save(); err != nil {
+				loggerFrom(ctx).Error("Failed to save fixtures", "dir", *record, "err", err)
+			}
+		}()
+	}
+	selfLink := config.absoluteURL(prefix)
+	rss, err := build(ctx, NewAtomLink(selfLink))
+	if err != nil {
+		return err
+	}
+	var out *bytes.Buffer
+	switch *format {
+	case "rss":
+		out, err = writeFeed(rss)
+	case "atom":
+		out, err = writeAtom(rss, selfLink)
+	case "json":
+		out, err = writeJSONFeed(rss, selfLink)
+	default:
+		return fmt.Errorf("Unknown feed format %s", *format)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimRight(out.String(), "\n"))
+	return nil
+}
+
+type command struct {
+	name        string
+	description string
+	run         func(context.Context, Config, []string) error
+}
+
+var commands = []command{
+	{"serve", "serve the feeds over http", runServe},
+	{"build", "export the feeds, index and opml as static files", runBuild},
+	{"discover", "discover the podcasts listed on radiocity and update the config", runDiscover},
+	{"validate", "check the config and the feeds for problems", runValidate},
+	{"fetch", "print the feed of a podcast prefix, or the master feed", runFetch},
+	{"opml", "export the podcasts as opml, or import podcasts from an opml file", runOPML},
+	{"mirror", "download the media of every podcast into the media directory", runMirror},
+	{"links", "check the enclosures and images of every podcast for dead links", runLinks},
+	{"notify", "post the episodes new since the last check to the webhooks", runNotify},
+	{"digest", "email the recipients of the digest the episodes new since the last run", runDigest},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] <command> [command flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-9s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(out, "\nWithout a command the master feed is fetched.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
+	configFile := flag.String("config", "", "podcast config json file, defaults to the built in podcasts")
+	logLevel := flag.String("log-level", "info", "minimum level to log (debug, info, warn, error)")
+	logFormat := flag.String("log-format", FormatLogfmt, "log output format (logfmt, json)")
+	replay := flag.String("replay", "", "answer requests from the fixtures recorded in this directory instead of radiocity")
+	flag.Parse()
 
-	rss, err := buildFeed(podcasts, NewAtomLink("http://localhost:8080/master"))
+	level, err := ParseLevel(*logLevel)
 	if err != nil {
-		panic(err)
+		fatal("Invalid log level", err)
 	}
-	out, err := writeFeed(rss)
+	logger, err := NewLogger(os.Stderr, level, *logFormat)
 	if err != nil {
-		panic(err)
+		fatal("Invalid log format", err)
+	}
+	rootLogger = logger
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fatal("Failed to load config", err)
+	}
+	if *replay != "" {
+		transport, err := newReplayTransport(*replay)
+		if err != nil {
+			fatal("Failed to load fixtures", err)
+		}
+		httpClient.Transport = transport
+	}
+
+	name, args := "fetch", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	ctx := context.Background()
+	if c := configArtwork(config); c != nil {
+		ctx = withArtwork(ctx, c)
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, config, args); err != nil {
+				fatal("Failed to run "+name, err)
+			}
+			return
+		}
 	}
-	fmt.Println(out.String())
+	flag.Usage()
+	os.Exit(2)
 }
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// mediaRoute is where the server serves the mirrored media
+const mediaRoute = "/media/"
+
+// mediaMirror keeps copies of the episode media in a directory. Each file
+// is downloaded to a .part file which is resumed with range requests
+// after a failure, and only renamed once complete, next to a .sha256 file
+// with its checksum in the format of sha256sum.
+type mediaMirror struct {
+	dir string
+	// workers download the queued media once the first is queued
+	workers int
+	queue   chan URL
+	start   sync.Once
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newMediaMirror(dir string) *mediaMirror {
+	return &mediaMirror{
+		dir:     dir,
+		workers: 2,
+		queue:   make(chan URL, 1000),
+		pending: make(map[string]bool),
+	}
+}
+
+// mediaFile names the mirrored copy of the media url, the name is made
+// readable from the url and unique by a hash of it
+func mediaFile(link URL) string {
+	ext := strings.ToLower(path.Ext(link.Path))
+	stem := strings.TrimSuffix(path.Base(link.Path), path.Ext(link.Path))
+	stem = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, stem)
+	if len(stem) > 80 {
+		stem = stem[:80]
+	}
+	u := url.URL(link)
+	sum := sha256.Sum256([]byte(u.String()))
+	return path.Join(strings.ToLower(u.Hostname()), stem+"-"+hex.EncodeToString(sum[:4])+ext)
+}
+
+func (m *mediaMirror) path(file string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(file))
+}
+
+// mirrored returns the file and size of the complete copy of the media url
+func (m *mediaMirror) mirrored(link URL) (string, int64, bool) {
+	file := mediaFile(link)
+	fi, err := os.Stat(m.path(file))
+	if err != nil {
+		return file, 0, false
+	}
+	if _, err := os.Stat(m.path(file) + ".sha256"); err != nil {
+		return file, 0, false
+	}
+	return file, fi.Size(), true
+}
+
+// mediaClient downloads media without the timeout of httpClient, which
+// would cut large files short, relying on the context instead
+func mediaClient() *http.Client {
+	return &http.Client{Transport: httpClient.Transport}
+}
+
+// download mirrors the media url unless it already is, resuming the
+// partial download left by an earlier attempt
+func (m *mediaMirror) download(ctx context.Context, link URL) (string, error) {
+	file, _, ok := m.mirrored(link)
+	if ok {
+		return file, nil
+	}
+	final := m.path(file)
+	part := final + ".part"
+	if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
+		return file, errors.Wrapf(err, "Failed to create media directory for %s", link.String())
+	}
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link.String(), nil)
+	if err != nil {
+		return file, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := mediaClient().Do(req)
+	if err != nil {
+		return file, errors.Wrapf(err, "Failed to download %s", link.String())
+	}
+	defer res.Body.Close()
+
+	flags, total := os.O_CREATE|os.O_WRONLY, int64(-1)
+	switch res.StatusCode {
+	case http.StatusOK:
+		flags, total = flags|os.O_TRUNC, res.ContentLength
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			return file, fmt.Errorf("%s responded with the range %q instead of resuming at %d", link.String(), res.Header.Get("Content-Range"), offset)
+		}
+		flags, total = flags|os.O_APPEND, size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial download is already complete when the range starts at its end
+		if _, size, err := parseContentRange(res.Header.Get("Content-Range")); err != nil || size != offset {
+			os.Remove(part)
+			return file, fmt.Errorf("%s cannot resume at %d", link.String(), offset)
+		}
+		return file, m.complete(file)
+	default:
+		return file, fmt.Errorf("%s returned status code %d", link.String(), res.StatusCode)
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return file, errors.Wrapf(err, "Failed to open %s", part)
+	}
+	_, err = io.Copy(f, res.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return file, errors.Wrapf(err, "Failed to download %s", link.String())
+	}
+	if total >= 0 {
+		fi, err := os.Stat(part)
+		if err != nil {
+			return file, err
+		}
+		if fi.Size() != total {
+			return file, fmt.Errorf("Downloaded %d of %d bytes of %s", fi.Size(), total, link.String())
+		}
+	}
+	return file, m.complete(file)
+}
+
+// parseContentRange reads the start and the total size from a
+// Content-Range header such as bytes 100-199/1000 or bytes */1000, the
+// size is -1 when unknown
+func parseContentRange(header string) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes ")
+	slash := strings.LastIndex(spec, "/")
+	if spec == header || slash == -1 {
+		return 0, 0, fmt.Errorf("Invalid Content-Range %q", header)
+	}
+	size := int64(-1)
+	if total := spec[slash+1:]; total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid Content-Range %q", header)
+		}
+		size = n
+	}
+	var start int64
+	if rng := spec[:slash]; rng != "*" {
+		dash := strings.Index(rng, "-")
+		if dash == -1 {
+			return 0, 0, fmt.Errorf("Invalid Content-Range %q", header)
+		}
+		n, err := strconv.ParseInt(rng[:dash], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid Content-Range %q", header)
+		}
+		start = n
+	}
+	return start, size, nil
+}
+
+// complete checksums the downloaded .part file and moves it in place
+func (m *mediaMirror) complete(file string) error {
+	final := m.path(file)
+	sum, err := fileChecksum(final + ".part")
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(final))
+	if err := ioutil.WriteFile(final+".sha256", []byte(line), 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write checksum of %s", file)
+	}
+	if err := os.Rename(final+".part", final); err != nil {
+		return errors.Wrapf(err, "Failed to move %s in place", file)
+	}
+	return nil
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "Failed to read %s", file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readChecksum reads the checksum recorded for the mirrored file
+func (m *mediaMirror) readChecksum(file string) (string, error) {
+	f, err := os.Open(m.path(file) + ".sha256")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString(' ')
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read checksum of %s", file)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// verify checks every mirrored file against its checksum, removing the
+// files which do not match so that they are downloaded again
+func (m *mediaMirror) verify() ([]string, error) {
+	var bad []string
+	err := filepath.Walk(m.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(p, ".sha256") {
+			return err
+		}
+		rel, _ := filepath.Rel(m.dir, strings.TrimSuffix(p, ".sha256"))
+		file := filepath.ToSlash(rel)
+		want, err := m.readChecksum(file)
+		if err != nil {
+			return err
+		}
+		if got, err := fileChecksum(m.path(file)); err == nil && got == want {
+			return nil
+		}
+		bad = append(bad, file)
+		os.Remove(m.path(file))
+		return os.Remove(p)
+	})
+	return bad, err
+}
+
+// mirrorAll downloads the media urls with a few workers, failures are
+// logged and returned once every download finished
+func (m *mediaMirror) mirrorAll(ctx context.Context, links []URL, workers int) (mirrored int, failed int) {
+	logger := loggerFrom(ctx).With("component", "mirror")
+	in := make(chan URL)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range in {
+				start := time.Now()
+				file, err := m.download(ctx, link)
+				mu.Lock()
+				if err != nil {
+					failed++
+					logger.Warn("Failed to mirror media", "url", link.String(), "err", err)
+				} else {
+					mirrored++
+					logger.Debug("Mirrored media", "url", link.String(), "file", file, "duration", time.Since(start))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	seen := make(map[string]bool)
+feed:
+	for _, link := range links {
+		if seen[link.String()] {
+			continue
+		}
+		seen[link.String()] = true
+		select {
+		case in <- link:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(in)
+	wg.Wait()
+	return mirrored, failed
+}
+
+// run mirrors the queued media urls in the background until the context
+// is done
+func (m *mediaMirror) run(ctx context.Context, workers int) {
+	logger := loggerFrom(ctx).With("component", "mirror")
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case link := <-m.queue:
+					if _, err := m.download(ctx, link); err != nil {
+						logger.Warn("Failed to mirror media", "url", link.String(), "err", err)
+					}
+					m.mu.Lock()
+					delete(m.pending, link.String())
+					m.mu.Unlock()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// enqueue queues the media urls which are not queued yet for the
+// background workers, dropping them when the queue is full. The workers
+// are started by the first call.
+func (m *mediaMirror) enqueue(links []URL) {
+	if len(links) == 0 {
+		return
+	}
+	m.start.Do(func() { m.run(context.Background(), m.workers) })
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, link := range links {
+		if m.pending[link.String()] {
+			continue
+		}
+		select {
+		case m.queue <- link:
+			m.pending[link.String()] = true
+		default:
+			return
+		}
+	}
+}
+
+// link points the enclosures which are mirrored at the copies, at the url
+// returned by mediaURL for the file, and returns the enclosures which are
+// not mirrored yet
+func (m *mediaMirror) link(channel *Channel, mediaURL func(file string) string) []URL {
+	var missing []URL
+	for i := range channel.Items {
+		enclosure := &channel.Items[i].Enclosure
+		if enclosure.URL.Host == "" {
+			continue
+		}
+		file, size, ok := m.mirrored(enclosure.URL)
+		if !ok {
+			missing = append(missing, enclosure.URL)
+			continue
+		}
+		u, err := parseURL(mediaURL(file))
+		if err != nil {
+			continue
+		}
+		enclosure.URL = u
+		enclosure.Length = int(size)
+		if ctype := mime.TypeByExtension(path.Ext(file)); ctype != "" {
+			enclosure.Type = ctype
+		}
+	}
+	return missing
+}
+
+// serverMediaURL links a file served by mediaRoute on the host of the feed
+func serverMediaURL(selfLink AtomLink) func(string) string {
+	return func(file string) string {
+		u := url.URL(selfLink.URL)
+		return u.ResolveReference(&url.URL{Path: mediaRoute + file}).String()
+	}
+}
+
+// feedBuilder links the feeds built by the builder to the mirrored media
+// and queues the media which is not mirrored yet
+func (m *mediaMirror) feedBuilder(builder FeedBuilder) FeedBuilder {
+	return func(ctx context.Context, podcast Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := builder(ctx, podcast, selfLink)
+		if err == nil {
+			m.enqueue(m.link(&rss.Channel, serverMediaURL(selfLink)))
+		}
+		return rss, err
+	}
+}
+
+// masterBuilder is feedBuilder for merged feeds
+func (m *mediaMirror) masterBuilder(master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := master(ctx, podcasts, selfLink)
+		if err == nil {
+			m.enqueue(m.link(&rss.Channel, serverMediaURL(selfLink)))
+		}
+		return rss, err
+	}
+}
+
+// ServeHTTP serves the complete mirrored files with range support, the
+// checksum is the etag
+func (m *mediaMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, mediaRoute)), "/")
+	if file == "" || strings.HasSuffix(file, ".part") || strings.HasSuffix(file, ".sha256") {
+		http.NotFound(w, r)
+		return
+	}
+	sum, err := m.readChecksum(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(m.path(file))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read media", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", `"`+sum+`"`)
+	if ctype := mime.TypeByExtension(path.Ext(file)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	http.ServeContent(w, r, file, fi.ModTime(), f)
+}
+
+// enclosureURLs lists the media urls of the items
+func enclosureURLs(items []Item) []URL {
+	var links []URL
+	for _, item := range items {
+		if item.Enclosure.URL.Host != "" {
+			links = append(links, item.Enclosure.URL)
+		}
+	}
+	return links
+}
+
+// runMirror implements the mirror command which downloads the media of
+// every podcast into the media directory
+func runMirror(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	dir := fs.String("dir", config.MediaDir, "directory to mirror the media into, defaults to mediaDir of the config")
+	workers := fs.Int("workers", 2, "number of files to download concurrently")
+	verify := fs.Bool("verify", false, "check the mirrored files against their checksums first, removing those which do not match")
+	fs.Parse(args)
+	if *workers < 1 {
+		return fmt.Errorf("-workers %d is not a positive number", *workers)
+	}
+	if *dir == "" {
+		return fmt.Errorf("No media directory, set mediaDir in the config or pass -dir")
+	}
+	logger := loggerFrom(ctx).With("component", "mirror")
+	m := newMediaMirror(*dir)
+	if *verify {
+		bad, err := m.verify()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to verify %s", *dir)
+		}
+		for _, file := range bad {
+			logger.Warn("Removed media not matching its checksum", "file", file)
+		}
+	}
+	var links []URL
+	for _, podcast := range config.Podcasts {
+		items, err := scrapeItems(ctx, podcast)
+		if err != nil {
+			logger.Error("Failed to scrape podcast", "podcast", podcast.Path, "err", err)
+			continue
+		}
+		links = append(links, enclosureURLs(items)...)
+	}
+	mirrored, failed := m.mirrorAll(ctx, links, *workers)
+	logger.Info("Mirrored media", "dir", *dir, "mirrored", mirrored, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("Failed to mirror %d of %d files", failed, mirrored+failed)
+	}
+	return nil
+}
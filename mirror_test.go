@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMirrorDownload(t *testing.T) {
+	fake := newFakeRadioCity(t)
+	m := newMediaMirror(t.TempDir())
+	link, _ := parseURL("https://" + mediaHost + "/Podcast/Crime Diary EP 38.mp3")
+	content := mediaContent(link.Path)
+	ctx := context.Background()
+
+	fake.set(func(f *fakeRadioCity) { f.CutAfter = 100000 })
+	file, err := m.download(ctx, link)
+	if err == nil {
+		t.Fatalf("Expected a dropped connection to fail the download")
+	}
+	if !strings.HasPrefix(file, mediaHost+"/Crime_Diary_EP_38-") || !strings.HasSuffix(file, ".mp3") {
+		t.Errorf("Unexpected media file %s", file)
+	}
+	if _, _, ok := m.mirrored(link); ok {
+		t.Errorf("Expected a partial download not to be mirrored")
+	}
+	fi, err := os.Stat(m.path(file) + ".part")
+	if err != nil || fi.Size() == 0 || fi.Size() > 100000 {
+		t.Fatalf("Expected the partial download to be kept\n%v", err)
+	}
+
+	fake.set(func(f *fakeRadioCity) { f.CutAfter = 0 })
+	if _, err := m.download(ctx, link); err != nil {
+		t.Fatalf("Failed to resume download\n%q", err)
+	}
+	if ranges := fake.RangeRequests(); len(ranges) != 1 || ranges[0] != "bytes="+strconv.FormatInt(fi.Size(), 10)+"-" {
+		t.Errorf("Expected the download to resume at %d but requested %v", fi.Size(), ranges)
+	}
+	buf, err := ioutil.ReadFile(m.path(file))
+	if err != nil || !bytes.Equal(buf, content) {
+		t.Fatalf("Expected the mirrored file to have the media content\n%v", err)
+	}
+	sum, err := m.readChecksum(file)
+	if want, _ := fileChecksum(m.path(file)); err != nil || sum != want {
+		t.Errorf("Expected the checksum %s but was %s\n%v", want, sum, err)
+	}
+
+	if bad, err := m.verify(); err != nil || len(bad) != 0 {
+		t.Errorf("Expected the mirror to verify but found %v\n%v", bad, err)
+	}
+	buf[0]++
+	if err := ioutil.WriteFile(m.path(file), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := m.verify(); err != nil || len(bad) != 1 || bad[0] != file {
+		t.Errorf("Expected the corrupted file to fail verification but found %v\n%v", bad, err)
+	}
+	if _, _, ok := m.mirrored(link); ok {
+		t.Errorf("Expected the corrupted file to be removed")
+	}
+}
+
+func TestMediaRoute(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	ctx := context.Background()
+	config := Config{Podcasts: podcasts[:1], MediaDir: t.TempDir()}
+	items, err := scrapeItems(ctx, podcasts[0])
+	if err != nil {
+		t.Fatalf("Failed to scrape %s\n%q", podcasts[0].Name, err)
+	}
+	// mirror everything up front so that the server queues nothing
+	if _, failed := newMediaMirror(config.MediaDir).mirrorAll(ctx, enclosureURLs(items), 4); failed > 0 {
+		t.Fatalf("Failed to mirror %d files", failed)
+	}
+	mux := newServeMux(config, scrapeFeed, buildFeed)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/cd", nil))
+	var rss RSS
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("Failed to unmarshal feed xml\n%q", err)
+	}
+	for _, item := range rss.Channel.Items {
+		if !strings.HasPrefix(item.Enclosure.URL.String(), "http://localhost:8080/media/"+mediaHost+"/") {
+			t.Errorf("Expected the enclosure to link the mirror but was %s", item.Enclosure.URL.String())
+		}
+		if !strings.HasPrefix(item.GUID.Value, "https://"+mediaHost+"/") {
+			t.Errorf("Expected the guid to keep the original url but was %s", item.GUID.Value)
+		}
+		if want := mediaLength(item.Link.Path); item.Enclosure.Length != want {
+			t.Errorf("Expected the mirrored length %d but was %d", want, item.Enclosure.Length)
+		}
+	}
+
+	media := rss.Channel.Items[0].Enclosure.URL.String()
+	r := httptest.NewRequest("GET", media, nil)
+	r.Header.Set("Range", "bytes=10-19")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected a partial response but was %d", w.Code)
+	}
+	if want := mediaContent(rss.Channel.Items[0].Link.Path)[10:20]; !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("Expected bytes 10-19 of the media")
+	}
+	if w.Header().Get("ETag") == "" || w.Header().Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("Expected an etag and the media type but headers were %v", w.Header())
+	}
+	// the handler is called directly, the mux would redirect to the clean path
+	m := newMediaMirror(config.MediaDir)
+	for _, path := range []string{media + ".sha256", "http://localhost:8080/media/../../testdata/config.json", "http://localhost:8080/media/"} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be served but was %d", path, w.Code)
+		}
+	}
+}
+
+func TestRunMirrorWorkers(t *testing.T) {
+	for _, workers := range []string{"0", "-1"} {
+		if err := runMirror(context.Background(), Config{MediaDir: t.TempDir()}, []string{"-workers", workers}); err == nil {
+			t.Errorf("Expected -workers %s to be rejected", workers)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OPML is an OPML 2.0 subscription list
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    OPMLHead `xml:"head"`
+	Body    OPMLBody `xml:"body"`
+}
+
+type OPMLHead struct {
+	Title string `xml:"title"`
+}
+
+type OPMLBody struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+type Outline struct {
+	Type     string    `xml:"type,attr,omitempty"`
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	Category string    `xml:"category,attr,omitempty"`
+	ImageURL string    `xml:"imageUrl,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// newOPML lists every podcast, feedURL returns the absolute url of its feed
+func newOPML(title string, podcasts []Podcast, feedURL func(Podcast) string) OPML {
+	opml := OPML{
+		Version: "2.0",
+		Head:    OPMLHead{Title: title},
+	}
+	for _, podcast := range podcasts {
+		opml.Body.Outlines = append(opml.Body.Outlines, Outline{
+			Type:     "rss",
+			Text:     podcast.Name,
+			Title:    podcast.Name,
+			XMLURL:   feedURL(podcast),
+			HTMLURL:  podcast.URL,
+			Category: joinCategories(podcast.Categories),
+			ImageURL: podcast.Image,
+		})
+	}
+	return opml
+}
+
+// joinCategories formats categories as the comma separated list of
+// slash delimited paths used by the OPML category attribute
+func joinCategories(categories []string) string {
+	var b bytes.Buffer
+	for i, category := range categories {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('/')
+		b.WriteString(category)
+	}
+	return b.String()
+}
+
+func writeOPML(opml OPML) (*bytes.Buffer, error) {
+	out := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if err := enc.Encode(opml); err != nil {
+		return out, errors.Wrap(err, "Failed to encode opml")
+	}
+	return out, nil
+}
+
+// splitCategories parses the OPML category attribute back into categories
+func splitCategories(attr string) []string {
+	var categories []string
+	for _, category := range strings.Split(attr, ",") {
+		if category = strings.Trim(strings.TrimSpace(category), "/"); category != "" {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+// readOPML parses an OPML document
+func readOPML(r io.Reader) (OPML, error) {
+	var opml OPML
+	if err := xml.NewDecoder(r).Decode(&opml); err != nil {
+		return opml, errors.Wrap(err, "Failed to parse opml")
+	}
+	return opml, nil
+}
+
+// importOPML turns the feed outlines, including nested ones, into podcasts.
+// The prefix is taken from the last path segment of the feed url without
+// its extension, the podcast page from the html url and the artwork from
+// the image url.
+func importOPML(ctx context.Context, opml OPML) []Podcast {
+	logger := loggerFrom(ctx).With("component", "opml")
+	var podcasts []Podcast
+	var walk func([]Outline)
+	walk = func(outlines []Outline) {
+		for _, outline := range outlines {
+			walk(outline.Outlines)
+			if outline.XMLURL == "" {
+				continue
+			}
+			if outline.HTMLURL == "" {
+				logger.Warn("Skipping outline without a podcast page", "text", outline.Text)
+				continue
+			}
+			feedURL, err := url.Parse(outline.XMLURL)
+			if err != nil {
+				logger.Warn("Skipping outline with invalid feed url", "text", outline.Text, "url", outline.XMLURL, "err", err)
+				continue
+			}
+			name := path.Base(feedURL.Path)
+			name = strings.TrimSuffix(name, path.Ext(name))
+			if name == "" || name == "." || name == "/" {
+				logger.Warn("Skipping outline without a feed path", "text", outline.Text, "url", outline.XMLURL)
+				continue
+			}
+			title := outline.Title
+			if title == "" {
+				title = outline.Text
+			}
+			podcasts = append(podcasts, Podcast{
+				Path:       "/" + name,
+				Name:       title,
+				URL:        outline.HTMLURL,
+				Image:      outline.ImageURL,
+				Categories: splitCategories(outline.Category),
+			})
+		}
+	}
+	walk(opml.Body.Outlines)
+	return podcasts
+}
+
+// mergePodcasts appends the podcasts whose prefix is not already in use
+func mergePodcasts(existing, added []Podcast) []Podcast {
+	merged := append([]Podcast{}, existing...)
+	seen := make(map[string]bool)
+	for _, podcast := range existing {
+		seen[podcast.Path] = true
+	}
+	for _, podcast := range added {
+		if !seen[podcast.Path] {
+			seen[podcast.Path] = true
+			merged = append(merged, podcast)
+		}
+	}
+	return merged
+}
+
+// OPMLHandler serves the subscription list with absolute feed urls
+func OPMLHandler(podcasts []Podcast) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base := requestBase(r)
+		out, err := writeOPML(newOPML("RadioCity Podcasts", podcasts, func(p Podcast) string {
+			return base + p.Path
+		}))
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to write opml", "err", err)
+			http.Error(w, "Failed to write opml", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+		w.Write(out.Bytes())
+	}
+}
+
+// runOPML implements the opml export and import commands
+func runOPML(ctx context.Context, config Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Expected opml export or opml import <file>")
+	}
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("opml export", flag.ExitOnError)
+		fs.StringVar(&config.BaseURL, "base-url", config.BaseURL, "absolute url the feeds are served at")
+		fs.Parse(args[1:])
+		out, err := writeOPML(newOPML("RadioCity Podcasts", config.Podcasts, func(p Podcast) string {
+			return config.absoluteURL(p.Path)
+		}))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	case "import":
+		fs := flag.NewFlagSet("opml import", flag.ExitOnError)
+		merge := fs.Bool("merge", false, "print the configured podcasts followed by the imported ones")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return fmt.Errorf("Expected the opml file to import")
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open %s", fs.Arg(0))
+		}
+		defer f.Close()
+		opml, err := readOPML(f)
+		if err != nil {
+			return err
+		}
+		imported := importOPML(ctx, opml)
+		if *merge {
+			imported = mergePodcasts(config.Podcasts, imported)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(imported)
+	}
+	return fmt.Errorf("Unknown opml command %s", args[0])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestOPMLRoundTrip(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	config := Config{BaseURL: "https://feeds.example.com", Podcasts: podcasts}
+	out, err := writeOPML(newOPML("Test", podcasts, func(p Podcast) string {
+		return config.absoluteURL(feedFile(p.Path, ".xml"))
+	}))
+	if err != nil {
+		t.Fatalf("Failed to write opml\n%q", err)
+	}
+	opml, err := readOPML(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read opml\n%q", err)
+	}
+	if opml.Version != "2.0" {
+		t.Errorf("Expected opml version 2.0 but was %s", opml.Version)
+	}
+	imported := importOPML(context.Background(), opml)
+	if len(imported) != len(podcasts) {
+		t.Fatalf("Expected to import %d podcasts but imported %d", len(podcasts), len(imported))
+	}
+	for i, podcast := range imported {
+		want := podcasts[i]
+		if podcast.Path != want.Path || podcast.Name != want.Name || podcast.URL != want.URL || podcast.Image != want.Image {
+			t.Errorf("Expected %v but imported %v", want, podcast)
+		}
+		if !reflect.DeepEqual(podcast.Categories, want.Categories) {
+			t.Errorf("Expected categories %v but imported %v", want.Categories, podcast.Categories)
+		}
+	}
+	if merged := mergePodcasts(podcasts, imported); len(merged) != len(podcasts) {
+		t.Errorf("Expected merging the same podcasts to add nothing but had %d", len(merged))
+	}
+}
+
+func TestOPMLHandler(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	r := httptest.NewRequest("GET", "http://feeds.example.com/opml", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	OPMLHandler(podcasts)(w, r)
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Did not respond with success")
+	}
+	opml, err := readOPML(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read opml\n%q", err)
+	}
+	for i, outline := range opml.Body.Outlines {
+		if want := "https://feeds.example.com" + podcasts[i].Path; outline.XMLURL != want {
+			t.Errorf("Expected feed url %s but was %s", want, outline.XMLURL)
+		}
+	}
+}
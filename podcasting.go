@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// podcastNS is the Podcasting 2.0 namespace, see
+// https://podcastindex.org/namespace/1.0
+const podcastNS = "https://podcastindex.org/namespace/1.0"
+
+// podcastGUIDNamespace is the uuid namespace podcast:guid values are
+// derived in
+var podcastGUIDNamespace = [16]byte{0xea, 0xd4, 0xc2, 0x36, 0xbf, 0x58, 0x58, 0xc6, 0xa2, 0xc6, 0xa6, 0xb2, 0x8d, 0x12, 0x8c, 0xb6}
+
+// podcastGUID is the version 5 uuid of the feed url without its scheme
+// and trailing slashes, as the namespace specifies
+func podcastGUID(feedURL string) string {
+	name := feedURL
+	if i := strings.Index(name, "://"); i != -1 {
+		name = name[i+3:]
+	}
+	name = strings.TrimRight(name, "/")
+	h := sha1.New()
+	h.Write(podcastGUIDNamespace[:])
+	h.Write([]byte(name))
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// PodcastLocked asks other platforms not to import the feed, the owner
+// email can unlock it
+type PodcastLocked struct {
+	XMLName xml.Name `xml:"podcast:locked"`
+	Owner   string   `xml:"owner,attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+// PodcastChapters links the chapters of an episode
+type PodcastChapters struct {
+	XMLName xml.Name `xml:"podcast:chapters"`
+	URL     URL      `xml:"url,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+// PodcastTranscript links a transcript of an episode
+type PodcastTranscript struct {
+	XMLName  xml.Name `xml:"podcast:transcript"`
+	URL      URL      `xml:"url,attr"`
+	Type     string   `xml:"type,attr"`
+	Language string   `xml:"language,attr,omitempty"`
+	Rel      string   `xml:"rel,attr,omitempty"`
+}
+
+// Episode adds the chapters and transcripts of an episode, matched by its
+// guid which is the media url as scraped
+type Episode struct {
+	GUID        string       `json:"guid"`
+	Chapters    string       `json:"chaptersUrl,omitempty"`
+	Transcripts []Transcript `json:"transcripts,omitempty"`
+}
+
+// Transcript is the config of a transcript, the type defaults to the one
+// of the file extension
+type Transcript struct {
+	URL      string `json:"url"`
+	Type     string `json:"type,omitempty"`
+	Language string `json:"language,omitempty"`
+	// Rel is captions for transcripts timed to be shown as captions
+	Rel string `json:"rel,omitempty"`
+}
+
+// transcriptTypes are the transcript formats the namespace lists
+var transcriptTypes = map[string]string{
+	".vtt":  "text/vtt",
+	".srt":  "application/x-subrip",
+	".json": "application/json",
+	".html": "text/html",
+	".htm":  "text/html",
+	".txt":  "text/plain",
+}
+
+// transcriptType is the configured type of the transcript or the one of
+// its extension
+func (t Transcript) transcriptType() string {
+	if t.Type != "" {
+		return t.Type
+	}
+	if u, err := url.Parse(t.URL); err == nil {
+		ext := strings.ToLower(path.Ext(u.Path))
+		if ctype, ok := transcriptTypes[ext]; ok {
+			return ctype
+		}
+		if ctype := mime.TypeByExtension(ext); ctype != "" {
+			return ctype
+		}
+	}
+	return "text/plain"
+}
+
+// describePodcast sets the podcast namespace tags of the channel from the
+// config of the podcast
+func describePodcast(channel *Channel, podcast Podcast) {
+	channel.PodcastGUID = podcast.GUID
+	if podcast.Locked {
+		channel.PodcastLocked = &PodcastLocked{Owner: podcast.Owner, Value: "yes"}
+	}
+}
+
+// addEpisodes links the chapters and transcripts configured for the items
+// of the podcast
+func addEpisodes(items []Item, podcast Podcast) {
+	if len(podcast.Episodes) == 0 {
+		return
+	}
+	episodes := make(map[string]Episode)
+	for _, episode := range podcast.Episodes {
+		episodes[episode.GUID] = episode
+	}
+	for i := range items {
+		episode, ok := episodes[items[i].GUID.Value]
+		if !ok {
+			continue
+		}
+		if u, err := parseURL(episode.Chapters); err == nil && episode.Chapters != "" {
+			items[i].PodcastChapters = &PodcastChapters{URL: u, Type: "application/json+chapters"}
+		}
+		for _, transcript := range episode.Transcripts {
+			u, err := parseURL(transcript.URL)
+			if err != nil || transcript.URL == "" {
+				continue
+			}
+			items[i].PodcastTranscripts = append(items[i].PodcastTranscripts, PodcastTranscript{
+				URL:      u,
+				Type:     transcript.transcriptType(),
+				Language: languageCode(transcript.Language),
+				Rel:      transcript.Rel,
+			})
+		}
+	}
+}
+
+// completePodcastTags fills in the podcast namespace tags derived from the
+// rest of the channel, the guid of the feed url and the language
+func completePodcastTags(channel *Channel) {
+	if channel.PodcastGUID == "" && channel.AtomLink.URL.Host != "" {
+		channel.PodcastGUID = podcastGUID(channel.AtomLink.URL.String())
+	}
+	if channel.PodcastLanguage == "" {
+		channel.PodcastLanguage = channel.Language
+	}
+}
+
+// validateEpisodes reports the episode config of the podcast which cannot
+// be linked
+func validateEpisodes(name string, podcast Podcast) []string {
+	var problems []string
+	absolute := func(link string) bool {
+		u, err := url.Parse(link)
+		return err == nil && u.IsAbs()
+	}
+	for i, episode := range podcast.Episodes {
+		if episode.GUID == "" {
+			problems = append(problems, fmt.Sprintf("%s: episode %d has no guid", name, i+1))
+		}
+		if episode.Chapters != "" && !absolute(episode.Chapters) {
+			problems = append(problems, fmt.Sprintf("%s: chaptersUrl %q is not an absolute url", name, episode.Chapters))
+		}
+		for _, transcript := range episode.Transcripts {
+			if !absolute(transcript.URL) {
+				problems = append(problems, fmt.Sprintf("%s: transcript url %q is not an absolute url", name, transcript.URL))
+			}
+			if transcript.Language != "" && languageCode(transcript.Language) == "" {
+				problems = append(problems, fmt.Sprintf("%s: transcript language %q is not a known language", name, transcript.Language))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPodcastGUID(t *testing.T) {
+	// the example of the namespace documentation
+	want := "917393e3-1b1e-5cef-ace4-edaa54e1f810"
+	for _, feed := range []string{"https://mp3s.nashownotes.com/pc20rss.xml", "http://mp3s.nashownotes.com/pc20rss.xml/"} {
+		if got := podcastGUID(feed); got != want {
+			t.Errorf("Expected the guid of %s to be %s but was %s", feed, want, got)
+		}
+	}
+}
+
+func TestPodcastTags(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	podcast := podcasts[0]
+	rss, err := scrapeFeed(context.Background(), podcast, NewAtomLink("https://feeds.example.com/cd"))
+	if err != nil {
+		t.Fatalf("Failed to scrape %s\n%q", podcast.Path, err)
+	}
+	guid := rss.Channel.Items[0].GUID.Value
+	podcast.Locked, podcast.Owner = true, "owner@example.com"
+	podcast.Episodes = []Episode{{
+		GUID:     guid,
+		Chapters: "https://feeds.example.com/chapters/38.json",
+		Transcripts: []Transcript{
+			{URL: "https://feeds.example.com/transcripts/38.vtt", Language: "tamil", Rel: "captions"},
+			{URL: "https://feeds.example.com/transcripts/38.html"},
+		},
+	}}
+	rss, err = scrapeFeed(context.Background(), podcast, NewAtomLink("https://feeds.example.com/cd"))
+	if err != nil {
+		t.Fatalf("Failed to scrape %s\n%q", podcast.Path, err)
+	}
+	out, err := writeFeed(rss)
+	if err != nil {
+		t.Fatalf("Failed to write feed\n%q", err)
+	}
+	feed := out.String()
+	for _, want := range []string{
+		`xmlns:podcast="https://podcastindex.org/namespace/1.0"`,
+		`<podcast:guid>` + podcastGUID("https://feeds.example.com/cd") + `</podcast:guid>`,
+		`<podcast:locked owner="owner@example.com">yes</podcast:locked>`,
+		`<podcast:language>ta</podcast:language>`,
+		`<podcast:chapters url="https://feeds.example.com/chapters/38.json" type="application/json+chapters"></podcast:chapters>`,
+		`<podcast:transcript url="https://feeds.example.com/transcripts/38.vtt" type="text/vtt" language="ta" rel="captions"></podcast:transcript>`,
+		`<podcast:transcript url="https://feeds.example.com/transcripts/38.html" type="text/html"></podcast:transcript>`,
+	} {
+		if !strings.Contains(feed, want) {
+			t.Errorf("Expected the feed to contain %s", want)
+		}
+	}
+	if strings.Count(feed, "<podcast:chapters") != 1 {
+		t.Errorf("Expected only the configured episode to have chapters")
+	}
+
+	podcast.GUID = "c0ffee00-0000-5000-8000-000000000000"
+	rss, err = scrapeFeed(context.Background(), podcast, NewAtomLink("https://feeds.example.com/cd"))
+	if err != nil {
+		t.Fatalf("Failed to scrape %s\n%q", podcast.Path, err)
+	}
+	if out, _ := writeFeed(rss); !strings.Contains(out.String(), "<podcast:guid>"+podcast.GUID+"</podcast:guid>") {
+		t.Errorf("Expected the configured guid to be kept")
+	}
+}
+
+func TestValidateEpisodes(t *testing.T) {
+	podcast := Podcast{Episodes: []Episode{
+		{GUID: "", Chapters: "chapters.json"},
+		{GUID: "a", Transcripts: []Transcript{{URL: "https://example.com/a.vtt", Language: "klingon"}}},
+	}}
+	problems := validateEpisodes("/cd", podcast)
+	for _, want := range []string{"episode 1 has no guid", `chaptersUrl "chapters.json"`, `language "klingon"`} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem, want)
+		}
+		if !found {
+			t.Errorf("Expected a problem with %s in %v", want, problems)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mediaHost = "prc.listenon.in"
+
+// TestMain keeps the scraper logs out of the test output unless -v is given
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		rootLogger, _ = NewLogger(ioutil.Discard, LevelError, FormatLogfmt)
+	}
+	os.Exit(m.Run())
+}
+
+// fakePages maps the host and path of every page the fake site serves to
+// the saved page in testdata. The landing page menu is the same on every
+// page so a show page doubles as the landing page.
+var fakePages = map[string]string{
+	"www.radiocity.in/":                                                "testdata/cd.html",
+	"www.radiocity.in/radiocity/tamil-podcasts":                        "testdata/tamil-podcasts.html",
+	"www.radiocity.in/radiocity/hindi-podcasts":                        "testdata/hindi-podcasts.html",
+	"www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153":   "testdata/cd.html",
+	"www.radiocity.in/radiocity/show-podcasts-hindi/Kissa-Crime-Ka/82": "testdata/kck.html",
+}
+
+// fakeRadioCity is an offline stand in for radiocity and its media host.
+// Every request made through httpClient is routed to it while a test runs.
+// Images on radiocity are served as blank pngs and media with made up
+// content and range support.
+type fakeRadioCity struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// Latency delays every response
+	Latency time.Duration
+	// Status responds to the host and path with the status code instead
+	Status map[string]int
+	// Down fails requests to the host and path at the transport
+	Down map[string]bool
+	// NoLength omits the Content-Length of media responses
+	NoLength bool
+	// ArtworkSize is the width and height of the images, 1400 when zero
+	ArtworkSize int
+	// ArtworkSizes overrides the size of the images at the host and path
+	ArtworkSizes map[string]int
+	// CutAfter drops the connection after sending as many bytes of media
+	// requested without a range
+	CutAfter int
+	requests []string
+	ranges   []string
+}
+
+func newFakeRadioCity(t *testing.T) *fakeRadioCity {
+	f := &fakeRadioCity{
+		Status:       make(map[string]int),
+		Down:         make(map[string]bool),
+		ArtworkSizes: make(map[string]int),
+	}
+	f.server = httptest.NewServer(f)
+	target, _ := url.Parse(f.server.URL)
+	saved := httpClient.Transport
+	httpClient.Transport = &fakeTransport{fake: f, target: target, base: f.server.Client().Transport}
+	t.Cleanup(func() {
+		httpClient.Transport = saved
+		f.server.Close()
+	})
+	return f
+}
+
+// set changes the knobs of the fake while requests may be in flight
+func (f *fakeRadioCity) set(change func(f *fakeRadioCity)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change(f)
+}
+
+// Requests lists the host and path of every request served so far
+func (f *fakeRadioCity) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+// mediaLength is a stable, made up size for each media file
+func mediaLength(p string) int {
+	return 1000000 + int(crc32.ChecksumIEEE([]byte(p))%1000000)
+}
+
+// mediaContent is the made up content of a media file
+func mediaContent(p string) []byte {
+	seed := crc32.ChecksumIEEE([]byte(p))
+	buf := make([]byte, mediaLength(p))
+	for i := range buf {
+		buf[i] = byte(uint32(i)*31 + seed)
+	}
+	return buf
+}
+
+// RangeRequests lists the Range header of every request which had one
+func (f *fakeRadioCity) RangeRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.ranges...)
+}
+
+func (f *fakeRadioCity) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Host + r.URL.Path
+	f.mu.Lock()
+	f.requests = append(f.requests, key)
+	if rng := r.Header.Get("Range"); rng != "" {
+		f.ranges = append(f.ranges, rng)
+	}
+	latency, status, noLength, size, cut := f.Latency, f.Status[key], f.NoLength, f.ArtworkSize, f.CutAfter
+	if n, ok := f.ArtworkSizes[key]; ok {
+		size = n
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if r.Host == mediaHost && path.Ext(r.URL.Path) == ".mp3" {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if noLength || r.Method == http.MethodHead {
+			if !noLength {
+				w.Header().Set("Content-Length", strconv.Itoa(mediaLength(r.URL.Path)))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		content := mediaContent(r.URL.Path)
+		if cut > 0 && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:cut])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		return
+	}
+	if ext := path.Ext(r.URL.Path); r.Host == "www.radiocity.in" && (ext == ".png" || ext == ".jpg") {
+		if size == 0 {
+			size = 1400
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, image.NewGray(image.Rect(0, 0, size, size)))
+		return
+	}
+	file, ok := fakePages[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf)
+}
+
+// fakeTransport sends every request to the fake server keeping the
+// original host so that the fake can tell the sites apart
+type fakeTransport struct {
+	fake   *fakeRadioCity
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.fake.mu.Lock()
+	down := t.fake.Down[req.URL.Host+req.URL.Path] || t.fake.Down[req.URL.Host]
+	t.fake.mu.Unlock()
+	if down {
+		return nil, errors.New("connection refused")
+	}
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = req.URL.Host
+	return t.base.RoundTrip(r)
+}
+
+func TestFakeEnclosures(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	podcast := podcasts[1]
+	fake := newFakeRadioCity(t)
+	ctx := context.Background()
+
+	rss, err := scrapeFeed(ctx, podcast, NewAtomLink("http://localhost:8080"+podcast.Path))
+	if err != nil {
+		t.Fatalf("Failed to scrape %s\n%q", podcast.Name, err)
+	}
+	for _, item := range rss.Channel.Items {
+		if want := mediaLength(item.Link.Path); item.Enclosure.Length != want {
+			t.Errorf("Expected enclosure length %d but was %d", want, item.Enclosure.Length)
+		}
+		if item.Enclosure.Type != "audio/mpeg" {
+			t.Errorf("Expected enclosure type audio/mpeg but was %s", item.Enclosure.Type)
+		}
+	}
+
+	first := rss.Channel.Items[0].Link
+	fake.set(func(f *fakeRadioCity) {
+		f.NoLength = true
+		f.Down[mediaHost+first.Path] = true
+	})
+	rss, err = scrapeFeed(ctx, podcast, NewAtomLink("http://localhost:8080"+podcast.Path))
+	if err != nil {
+		t.Fatalf("Expected media failures not to fail the feed\n%q", err)
+	}
+	for _, item := range rss.Channel.Items {
+		if item.Enclosure.Length != 0 {
+			t.Errorf("Expected an unknown enclosure length but was %d", item.Enclosure.Length)
+		}
+		if item.Enclosure.URL.Scheme == "" {
+			t.Errorf("Expected the enclosure url to be kept")
+		}
+	}
+}
+
+func TestFakeFailures(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	podcast := podcasts[0]
+	page, _ := url.Parse(podcast.URL)
+	fake := newFakeRadioCity(t)
+	selfLink := NewAtomLink("http://localhost:8080" + podcast.Path)
+
+	fake.set(func(f *fakeRadioCity) { f.Status[page.Host+page.Path] = http.StatusServiceUnavailable })
+	if _, err := scrapeFeed(context.Background(), podcast, selfLink); err == nil {
+		t.Errorf("Expected a failing show page to fail the feed")
+	}
+
+	fake.set(func(f *fakeRadioCity) {
+		delete(f.Status, page.Host+page.Path)
+		f.Latency = time.Second
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := scrapeFeed(ctx, podcast, selfLink); err == nil {
+		t.Errorf("Expected a slow show page to time out")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the scrape to stop once the context expired")
+	}
+}
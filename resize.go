@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	artworkRoute = "/artwork/"
+	// defaultArtworkSize is the size of the artwork linked from the feeds
+	defaultArtworkSize = 1400
+	// artworkMaxAge is how long rendered artwork is served before the
+	// source is loaded again
+	artworkMaxAge = 7 * 24 * time.Hour
+	// maxSourceSide keeps huge images from being decoded, the largest
+	// artwork allowed bounds the memory of a render to a few hundred MB
+	maxSourceSide = maxArtwork
+	// artworkRenders is how many artwork are rendered at once
+	artworkRenders = 2
+)
+
+// artworkProxy serves the artwork of the feeds padded to a square and
+// resized, at /artwork/<size>/<host>/<path>. The rendered images are kept
+// in a directory laid out like the urls. Only the configured size and the
+// hosts of the configured images and radiocity are proxied.
+type artworkProxy struct {
+	dir  string
+	size int
+	// hosts maps the hosts proxied to the scheme their images are loaded with
+	hosts map[string]string
+	// renders limits the artwork rendered at once
+	renders chan struct{}
+
+	mu sync.Mutex
+	// rendering holds the files being rendered, closed once done
+	rendering map[string]chan struct{}
+}
+
+func newArtworkProxy(config Config) *artworkProxy {
+	p := &artworkProxy{
+		dir:       config.ArtworkDir,
+		size:      config.ArtworkSize,
+		hosts:     make(map[string]string),
+		renders:   make(chan struct{}, artworkRenders),
+		rendering: make(map[string]chan struct{}),
+	}
+	if p.size == 0 {
+		p.size = defaultArtworkSize
+	}
+	for host := range httpsHosts {
+		p.hosts[host] = "https"
+	}
+	images := []string{masterImage, config.master().Image}
+	for _, podcast := range config.Podcasts {
+		images = append(images, podcast.Image)
+	}
+	for _, feed := range config.Feeds {
+		images = append(images, feed.Image)
+	}
+	for _, img := range images {
+		if u, err := url.Parse(img); err == nil && u.Host != "" {
+			if host := strings.ToLower(u.Host); p.hosts[host] == "" {
+				p.hosts[host] = u.Scheme
+			}
+		}
+	}
+	return p
+}
+
+// artworkFile is the path of the artwork of the source image at the size
+// below the route, empty when the host is not proxied
+func (p *artworkProxy) artworkFile(source URL, size int) string {
+	if p.hosts[source.Host] == "" || source.RawQuery != "" {
+		return ""
+	}
+	return path.Join(strconv.Itoa(size), source.Host, path.Clean("/"+source.Path))
+}
+
+// parseArtworkFile splits the path below the route into the size, the
+// source image and the format to render. A .png or .jpg added to the path
+// of a source image selects the format, otherwise it is the format of the
+// source image with png for anything other than jpeg.
+func (p *artworkProxy) parseArtworkFile(file string) (int, URL, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+file), "/"), "/", 3)
+	if len(parts) != 3 {
+		return 0, URL{}, "", fmt.Errorf("%s is not an artwork path", file)
+	}
+	size, err := strconv.Atoi(parts[0])
+	if err != nil || size != p.size {
+		return 0, URL{}, "", fmt.Errorf("size %q is not the artwork size %d", parts[0], p.size)
+	}
+	host, src := parts[1], "/"+parts[2]
+	scheme := p.hosts[host]
+	if scheme == "" {
+		return 0, URL{}, "", fmt.Errorf("%s is not an artwork host", host)
+	}
+	format := imageFormat(src)
+	switch ext := strings.ToLower(path.Ext(src)); ext {
+	case ".png", ".jpg", ".jpeg":
+		if inner := strings.TrimSuffix(src, path.Ext(src)); path.Ext(inner) != "" && isImageExt(path.Ext(inner)) {
+			src = inner
+		}
+	}
+	source, err := parseURL((&url.URL{Scheme: scheme, Host: host, Path: src}).String())
+	return size, source, format, err
+}
+
+func isImageExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// imageFormat is the format artwork is rendered in for the path
+func imageFormat(p string) string {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	}
+	return "png"
+}
+
+// render loads the source image and encodes it padded to a square of the
+// size
+func render(ctx context.Context, source URL, size int, format string) ([]byte, error) {
+	buf, err := loadUrl(ctx, source.String())
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s is not an image", source.String())
+	}
+	if cfg.Width > maxSourceSide || cfg.Height > maxSourceSide {
+		return nil, fmt.Errorf("%s is %dx%d, larger than %dx%d", source.String(), cfg.Width, cfg.Height, maxSourceSide, maxSourceSide)
+	}
+	src, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode %s", source.String())
+	}
+	var out bytes.Buffer
+	img := squareImage(src, size)
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&out, img)
+	}
+	return out.Bytes(), errors.Wrapf(err, "Failed to encode %s", source.String())
+}
+
+// rendered returns the file of the artwork, rendering it unless a fresh
+// copy is kept. Stale copies are served when the source fails to load. A
+// file is rendered once at a time and at most artworkRenders files at once.
+func (p *artworkProxy) rendered(ctx context.Context, file string) (string, error) {
+	size, source, format, err := p.parseArtworkFile(file)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(p.dir, filepath.FromSlash(path.Clean("/"+file)))
+	fresh := func() bool {
+		fi, err := os.Stat(name)
+		return err == nil && now().Sub(fi.ModTime()) < artworkMaxAge
+	}
+	var done chan struct{}
+	for {
+		if fresh() {
+			return name, nil
+		}
+		p.mu.Lock()
+		rendering, ok := p.rendering[name]
+		if !ok {
+			done = make(chan struct{})
+			p.rendering[name] = done
+			p.mu.Unlock()
+			break
+		}
+		p.mu.Unlock()
+		select {
+		case <-rendering:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	defer func() {
+		p.mu.Lock()
+		delete(p.rendering, name)
+		p.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case p.renders <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-p.renders }()
+	start := time.Now()
+	buf, err := render(ctx, source, size, format)
+	if err != nil {
+		if _, serr := os.Stat(name); serr == nil {
+			loggerFrom(ctx).Warn("Serving stale artwork", "component", "artwork", "url", source.String(), "err", err)
+			return name, nil
+		}
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", errors.Wrap(err, "Failed to create artwork directory")
+	}
+	if _, err := writeIfChanged(name, buf); err != nil {
+		return "", err
+	}
+	// an unchanged rendering still counts as fresh
+	t := now()
+	os.Chtimes(name, t, t)
+	loggerFrom(ctx).Info("Rendered artwork", "component", "artwork", "url", source.String(), "size", size, "format", format, "duration", time.Since(start))
+	return name, nil
+}
+
+// ServeHTTP serves the rendered artwork, unknown hosts are not found and
+// sources which fail to load are a bad gateway
+func (p *artworkProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(r.URL.Path, artworkRoute)
+	if _, _, _, err := p.parseArtworkFile(file); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	name, err := p.rendered(r.Context(), file)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("Failed to render artwork", "component", "artwork", "file", file, "err", err)
+		http.Error(w, "Failed to load artwork", http.StatusBadGateway)
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		http.Error(w, "Failed to read artwork", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read artwork", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+imageFormat(file))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// link points the itunes images of the channel and its items at the
+// artwork, images on other hosts are left alone. The files linked are
+// returned.
+func (p *artworkProxy) link(channel *Channel, artworkURL func(file string) string) []string {
+	var files []string
+	seen := make(map[string]bool)
+	rewrite := func(img *ItunesImage) {
+		file := p.artworkFile(img.URL, p.size)
+		if file == "" {
+			return
+		}
+		u, err := parseURL(artworkURL(file))
+		if err != nil {
+			return
+		}
+		img.URL = u
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	rewrite(&channel.ItunesImage)
+	for i := range channel.Items {
+		rewrite(&channel.Items[i].ItunesImage)
+	}
+	return files
+}
+
+// serverArtworkURL links a file served by artworkRoute on the host of the
+// feed
+func serverArtworkURL(selfLink AtomLink) func(string) string {
+	return func(file string) string {
+		u := url.URL(selfLink.URL)
+		return u.ResolveReference(&url.URL{Path: artworkRoute + file}).String()
+	}
+}
+
+// feedBuilder links the feeds built by the builder to the artwork
+func (p *artworkProxy) feedBuilder(builder FeedBuilder) FeedBuilder {
+	return func(ctx context.Context, podcast Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := builder(ctx, podcast, selfLink)
+		if err == nil {
+			p.link(&rss.Channel, serverArtworkURL(selfLink))
+		}
+		return rss, err
+	}
+}
+
+// masterBuilder is feedBuilder for merged feeds
+func (p *artworkProxy) masterBuilder(master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		rss, err := master(ctx, podcasts, selfLink)
+		if err == nil {
+			p.link(&rss.Channel, serverArtworkURL(selfLink))
+		}
+		return rss, err
+	}
+}
+
+// squareImage pads the image to a square with the average color of its
+// border and resizes it to size x size
+func squareImage(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() > side {
+		side = b.Dy()
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{borderColor(src)}, image.Point{}, draw.Src)
+	offset := image.Pt((side-b.Dx())/2, (side-b.Dy())/2)
+	draw.Draw(canvas, image.Rectangle{offset, offset.Add(b.Size())}, src, b.Min, draw.Over)
+	return resize(canvas, size, size)
+}
+
+// borderColor is the opaque average color of the outermost pixels
+func borderColor(src image.Image) color.RGBA {
+	b := src.Bounds()
+	var r, g, bl, n uint64
+	add := func(x, y int) {
+		cr, cg, cb, _ := src.At(x, y).RGBA()
+		r, g, bl, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), n+1
+	}
+	for x := b.Min.X; x < b.Max.X; x++ {
+		add(x, b.Min.Y)
+		add(x, b.Max.Y-1)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		add(b.Min.X, y)
+		add(b.Max.X-1, y)
+	}
+	if n == 0 {
+		return color.RGBA{A: 0xff}
+	}
+	return color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 0xff}
+}
+
+// contribution is the weights of the source pixels from start making up
+// a resized pixel
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// filterWeights computes the triangle filter from in to out pixels, the
+// filter widens when shrinking so every source pixel counts
+func filterWeights(in, out int) []contribution {
+	scale := float64(in) / float64(out)
+	support := math.Max(scale, 1)
+	contribs := make([]contribution, out)
+	for i := range contribs {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		if start < 0 {
+			start = 0
+		}
+		if end > in-1 {
+			end = in - 1
+		}
+		var weights []float64
+		sum := 0.0
+		for j := start; j <= end; j++ {
+			w := 1 - math.Abs(float64(j)-center)/support
+			if w < 0 {
+				w = 0
+			}
+			weights = append(weights, w)
+			sum += w
+		}
+		if sum == 0 {
+			nearest := int(math.Round(center))
+			if nearest < 0 {
+				nearest = 0
+			}
+			if nearest > in-1 {
+				nearest = in - 1
+			}
+			contribs[i] = contribution{start: nearest, weights: []float64{1}}
+			continue
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		contribs[i] = contribution{start: start, weights: weights}
+	}
+	return contribs
+}
+
+// resize scales the image to width x height, rows first and then columns
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	b := src.Bounds()
+	cols, rows := filterWeights(b.Dx(), width), filterWeights(b.Dy(), height)
+	// tmp holds the rows of the source resized to the width
+	tmp := make([]float64, b.Dy()*width*4)
+	for y := 0; y < b.Dy(); y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, c := range cols {
+			var px [4]float64
+			for k, w := range c.weights {
+				o := (c.start + k) * 4
+				for ch := 0; ch < 4; ch++ {
+					px[ch] += w * float64(row[o+ch])
+				}
+			}
+			copy(tmp[(y*width+x)*4:], px[:])
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, c := range rows {
+		for x := 0; x < width; x++ {
+			var px [4]float64
+			for k, w := range c.weights {
+				o := ((c.start+k)*width + x) * 4
+				for ch := 0; ch < 4; ch++ {
+					px[ch] += w * tmp[o+ch]
+				}
+			}
+			for ch := 0; ch < 4; ch++ {
+				dst.Pix[y*dst.Stride+x*4+ch] = uint8(math.Max(0, math.Min(255, math.Round(px[ch]))))
+			}
+		}
+	}
+	return dst
+}
+
+// exportArtwork renders the artwork of the files into the artwork
+// directory of the static site
+func (p *artworkProxy) exportArtwork(ctx context.Context, report *buildReport, dir string, files []string) {
+	logger := loggerFrom(ctx).With("component", "build")
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		name, err := p.rendered(ctx, file)
+		if err != nil {
+			logger.Warn("Failed to render artwork", "file", file, "err", err)
+			continue
+		}
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			logger.Warn("Failed to read artwork", "file", file, "err", err)
+			continue
+		}
+		out := path.Join("artwork", file)
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(filepath.FromSlash(out))), 0755); err != nil {
+			logger.Warn("Failed to create artwork directory", "file", file, "err", err)
+			continue
+		}
+		if err := report.write(dir, filepath.FromSlash(out), buf); err != nil {
+			logger.Warn("Failed to write artwork", "file", file, "err", err)
+		}
+	}
+}
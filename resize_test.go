@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSquareImage(t *testing.T) {
+	// a wide red image with a white border
+	src := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(2, 2, 298, 98), &image.Uniform{color.RGBA{0xff, 0, 0, 0xff}}, image.Point{}, draw.Src)
+
+	img := squareImage(src, 90)
+	if b := img.Bounds(); b.Dx() != 90 || b.Dy() != 90 {
+		t.Fatalf("Expected a 90x90 image but was %dx%d", b.Dx(), b.Dy())
+	}
+	if c := img.RGBAAt(45, 5); c != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("Expected the padding to have the border color but was %v", c)
+	}
+	if c := img.RGBAAt(45, 45); c.R < 0xf0 || c.G > 0x10 || c.A != 0xff {
+		t.Errorf("Expected the middle to stay red but was %v", c)
+	}
+
+	up := squareImage(image.NewGray(image.Rect(0, 0, 40, 40)), 1400)
+	if b := up.Bounds(); b.Dx() != 1400 || b.Dy() != 1400 {
+		t.Errorf("Expected a 1400x1400 image but was %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestFilterWeights(t *testing.T) {
+	for _, sizes := range [][2]int{{1, 1400}, {40, 1400}, {1400, 1400}, {3000, 1400}, {5, 2}} {
+		for i, c := range filterWeights(sizes[0], sizes[1]) {
+			sum := 0.0
+			for _, w := range c.weights {
+				sum += w
+			}
+			if c.start < 0 || c.start+len(c.weights) > sizes[0] || math.Abs(sum-1) > 1e-9 {
+				t.Fatalf("Expected the weights of pixel %d of %d to %d to cover the source and add up to 1 but were %+v", i, sizes[0], sizes[1], c)
+			}
+		}
+	}
+}
+
+func TestArtworkProxy(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	fake := newFakeRadioCity(t)
+	fake.set(func(f *fakeRadioCity) { f.ArtworkSize = 300 })
+	config := Config{Podcasts: podcasts, ArtworkDir: t.TempDir()}
+	mux := newServeMux(config, scrapeFeed, buildFeed)
+
+	podcast := podcasts[0]
+	builder := newArtworkProxy(config).feedBuilder(scrapeFeed)
+	rss, err := builder(context.Background(), podcast, NewAtomLink("http://localhost:8080"+podcast.Path))
+	if err != nil {
+		t.Fatalf("Failed to build feed\n%q", err)
+	}
+	artwork := rss.Channel.ItunesImage.URL
+	if artwork.Host != "localhost:8080" || !strings.HasPrefix(artwork.Path, "/artwork/1400/www.radiocity.in/images/") {
+		t.Fatalf("Expected the itunes image to link the artwork but was %s", artwork.String())
+	}
+	if rss.Channel.Image.URL.Host != "www.radiocity.in" {
+		t.Errorf("Expected the rss image to keep linking radiocity but was %s", rss.Channel.Image.URL.String())
+	}
+	for _, item := range rss.Channel.Items {
+		if item.ItunesImage.URL != artwork {
+			t.Errorf("Expected %q to link the artwork but was %s", item.Title, item.ItunesImage.URL.String())
+		}
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	w := get(artwork.RequestURI())
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected the artwork as a jpeg but was %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || cfg.Width != 1400 || cfg.Height != 1400 {
+		t.Errorf("Expected a 1400x1400 jpeg but was %dx%d\n%v", cfg.Width, cfg.Height, err)
+	}
+	loaded := len(fake.Requests())
+	if w := get(artwork.RequestURI()); w.Code != http.StatusOK || len(fake.Requests()) != loaded {
+		t.Errorf("Expected the rendered artwork to be served from the cache")
+	}
+
+	w = get(artwork.RequestURI() + ".png")
+	if cfg, err := png.DecodeConfig(bytes.NewReader(w.Body.Bytes())); w.Code != http.StatusOK || err != nil || cfg.Width != 1400 {
+		t.Errorf("Expected a 1400x1400 png but was %d %dx%d\n%v", w.Code, cfg.Width, cfg.Height, err)
+	}
+	for _, path := range []string{
+		"/artwork/1400/example.com/images/a.jpg",
+		"/artwork/5000/www.radiocity.in/images/a.jpg",
+		strings.Replace(artwork.RequestURI(), "/1400/", "/200/", 1),
+		"/artwork/big/www.radiocity.in/images/a.jpg",
+		"/artwork/1400/www.radiocity.in",
+	} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be found but was %d", path, w.Code)
+		}
+	}
+
+	// concurrent requests for the same artwork render it once
+	mux = newServeMux(Config{Podcasts: podcasts, ArtworkDir: t.TempDir()}, scrapeFeed, buildFeed)
+	loaded = len(fake.Requests())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(artwork.RequestURI())
+		}()
+	}
+	wg.Wait()
+	if requests := fake.Requests()[loaded:]; len(requests) != 1 {
+		t.Errorf("Expected the source to be loaded once but was loaded %d times", len(requests))
+	}
+
+	fake.set(func(f *fakeRadioCity) { f.Status["www.radiocity.in/images/missing.jpg"] = http.StatusNotFound })
+	if w := get("/artwork/1400/www.radiocity.in/images/missing.jpg"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a missing source to be a bad gateway but was %d", w.Code)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Refresh scrapes the podcasts in the background with serve, the feeds are
+// served from the latest scrape instead of scraping on request
+type Refresh struct {
+	// Interval between the refreshes of a podcast, eg. "30m", 1h when not
+	// set. A podcast overrides it with its own refresh.
+	Interval string `json:"interval,omitempty"`
+	// Jitter spreads the refreshes by up to this fraction of the interval,
+	// 0.1 when not set
+	Jitter float64 `json:"jitter,omitempty"`
+	// QuietHours is the time of day in IST no refresh starts in, eg.
+	// "01:00-06:00"
+	QuietHours string `json:"quietHours,omitempty"`
+	// State is the json file the last refreshes are kept in between runs
+	State string `json:"state,omitempty"`
+}
+
+const (
+	defaultRefreshInterval = time.Hour
+	minRefreshInterval     = 5 * time.Minute
+	defaultRefreshJitter   = 0.1
+	// dormantAfter is how long a podcast has not published before its
+	// refreshes back off, doubling every 30 days up to a day
+	dormantAfter = 60 * 24 * time.Hour
+	// maxBackoffInterval caps the interval of dormant and failing podcasts
+	maxBackoffInterval = 24 * time.Hour
+	// retryInterval is the wait after the first failed refresh, doubled
+	// with every failure up to the interval
+	retryInterval = 5 * time.Minute
+	// startupSpread is the time the podcasts are first refreshed over
+	startupSpread = time.Minute
+	scheduleRoute = "/schedule"
+)
+
+// refreshGap is the least time between two refreshes, so that radiocity
+// sees steady traffic even when many podcasts are due
+var refreshGap = 5 * time.Second
+
+// interval is the refresh interval of the podcast
+func (r Refresh) interval(podcast Podcast) time.Duration {
+	for _, setting := range []string{podcast.Refresh, r.Interval} {
+		if d, err := time.ParseDuration(setting); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultRefreshInterval
+}
+
+func (r Refresh) jitter() float64 {
+	if r.Jitter == 0 {
+		return defaultRefreshJitter
+	}
+	return r.Jitter
+}
+
+// quietHours is a time of day range in minutes after midnight IST, it
+// wraps around midnight when from is after to
+type quietHours struct {
+	from, to int
+}
+
+// parseQuietHours parses a "15:04-15:04" range, empty is no quiet hours
+func parseQuietHours(s string) (quietHours, error) {
+	var q quietHours
+	if s == "" {
+		return q, nil
+	}
+	var fh, fm, th, tm int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &fh, &fm, &th, &tm); err != nil || fh > 23 || th > 23 || fm > 59 || tm > 59 || fh < 0 || th < 0 || fm < 0 || tm < 0 {
+		return q, fmt.Errorf("quietHours %q is not a range like 01:00-06:00", s)
+	}
+	return quietHours{from: fh*60 + fm, to: th*60 + tm}, nil
+}
+
+// end returns when the quiet hours t falls in end, false when t is not in
+// the quiet hours
+func (q quietHours) end(t time.Time) (time.Time, bool) {
+	if q.from == q.to {
+		return t, false
+	}
+	local := t.In(istLocation)
+	m := local.Hour()*60 + local.Minute()
+	quiet := m >= q.from && m < q.to
+	if q.from > q.to {
+		quiet = m >= q.from || m < q.to
+	}
+	if !quiet {
+		return t, false
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, istLocation).Add(time.Duration(q.to) * time.Minute)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, true
+}
+
+// podcastRefresh is the refresh state of a podcast
+type podcastRefresh struct {
+	LastRun     time.Time `json:"lastRun,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	// Latest is the publish date of the latest episode
+	Latest   time.Time `json:"latestEpisode,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Next     time.Time `json:"next"`
+}
+
+// scheduler refreshes each podcast on its interval one at a time and keeps
+// the scraped channels
+type scheduler struct {
+	settings Refresh
+	podcasts []Podcast
+	quiet    quietHours
+	// random returns a number in [0, 1) to jitter the refreshes
+	random func() float64
+
+	mu       sync.Mutex
+	state    map[string]*podcastRefresh
+	channels map[string]Channel
+}
+
+// newScheduler loads the state of the last refreshes. Podcasts refreshed
+// before keep their schedule, the others are refreshed soon after the start
+// to warm the feeds.
+func newScheduler(config Config) (*scheduler, error) {
+	settings := Refresh{}
+	if config.Refresh != nil {
+		settings = *config.Refresh
+	}
+	quiet, err := parseQuietHours(settings.QuietHours)
+	if err != nil {
+		return nil, err
+	}
+	s := &scheduler{
+		settings: settings,
+		podcasts: config.Podcasts,
+		quiet:    quiet,
+		random:   rand.Float64,
+		state:    make(map[string]*podcastRefresh),
+		channels: make(map[string]Channel),
+	}
+	if settings.State != "" {
+		buf, err := ioutil.ReadFile(settings.State)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Failed to read refresh state %s", settings.State)
+		}
+		if err == nil {
+			if err := json.Unmarshal(buf, &s.state); err != nil {
+				return nil, errors.Wrapf(err, "Failed to parse refresh state %s", settings.State)
+			}
+		}
+	}
+	var unrefreshed []*podcastRefresh
+	for _, podcast := range s.podcasts {
+		st, ok := s.state[podcast.Path]
+		if !ok {
+			st = &podcastRefresh{}
+			s.state[podcast.Path] = st
+		}
+		switch {
+		case st.LastRun.IsZero():
+			unrefreshed = append(unrefreshed, st)
+		case st.Next.IsZero():
+			st.Next = s.next(podcast, *st, st.LastRun)
+		}
+	}
+	start := now()
+	for i, st := range unrefreshed {
+		st.Next = start.Add(startupSpread * time.Duration(i) / time.Duration(len(unrefreshed)))
+	}
+	return s, nil
+}
+
+// next is when the podcast is refreshed after t. Failing podcasts are
+// retried sooner and podcasts which have not published in months later.
+func (s *scheduler) next(podcast Podcast, st podcastRefresh, t time.Time) time.Time {
+	interval := s.settings.interval(podcast)
+	switch {
+	case st.Failures > 0:
+		retry := retryInterval
+		for i := 1; i < st.Failures && retry < interval; i++ {
+			retry *= 2
+		}
+		if retry < interval {
+			interval = retry
+		}
+	case !st.Latest.IsZero() && t.Sub(st.Latest) > dormantAfter:
+		backoff := interval
+		for age := t.Sub(st.Latest); age > dormantAfter && backoff < maxBackoffInterval; age -= 30 * 24 * time.Hour {
+			backoff *= 2
+		}
+		if backoff > maxBackoffInterval {
+			backoff = maxBackoffInterval
+		}
+		if backoff > interval {
+			interval = backoff
+		}
+	}
+	spread := s.settings.jitter() * float64(interval)
+	next := t.Add(interval + time.Duration((2*s.random()-1)*spread))
+	if end, quiet := s.quiet.end(next); quiet {
+		next = end.Add(time.Duration(s.random() * spread))
+	}
+	return next
+}
+
+// refresh scrapes the podcast and keeps its channel, the previous channel
+// is kept when the scrape fails
+func (s *scheduler) refresh(ctx context.Context, podcast Podcast) error {
+	// scrape radiocity rather than the channel kept
+	channel, err := scrapeChannel(withScheduler(ctx, nil), podcast, AtomLink{})
+	t := now()
+	s.mu.Lock()
+	st := s.state[podcast.Path]
+	st.LastRun = t
+	if err != nil {
+		st.Failures++
+		st.Error = err.Error()
+	} else {
+		st.Failures, st.Error = 0, ""
+		st.LastSuccess = t
+		if latest := latestDate(channel.Items); !latest.IsZero() {
+			st.Latest = latest
+		}
+		s.channels[podcast.Path] = channel
+	}
+	st.Next = s.next(podcast, *st, t)
+	s.mu.Unlock()
+	if saveErr := s.save(); saveErr != nil {
+		loggerFrom(ctx).Warn("Failed to save refresh state", "component", "schedule", "err", saveErr)
+	}
+	return err
+}
+
+// save writes the refresh state
+func (s *scheduler) save() error {
+	if s.settings.State == "" {
+		return nil
+	}
+	s.mu.Lock()
+	buf, err := json.MarshalIndent(s.state, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.settings.State), 0755); err != nil {
+		return errors.Wrap(err, "Failed to create refresh state directory")
+	}
+	_, err = writeIfChanged(s.settings.State, buf)
+	return err
+}
+
+// due returns the podcast refreshed next and when
+func (s *scheduler) due() (Podcast, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next Podcast
+	var at time.Time
+	for _, podcast := range s.podcasts {
+		st := s.state[podcast.Path]
+		if at.IsZero() || st.Next.Before(at) {
+			next, at = podcast, st.Next
+		}
+	}
+	return next, at
+}
+
+// step refreshes the podcast which is due, quiet hours postpone it, and
+// returns the time until the next one is due
+func (s *scheduler) step(ctx context.Context) time.Duration {
+	podcast, at := s.due()
+	t := now()
+	if at.After(t) {
+		return at.Sub(t)
+	}
+	if end, quiet := s.quiet.end(t); quiet {
+		s.mu.Lock()
+		s.state[podcast.Path].Next = end.Add(time.Duration(s.random() * s.settings.jitter() * float64(s.settings.interval(podcast))))
+		s.mu.Unlock()
+		return 0
+	}
+	logger := loggerFrom(ctx).With("component", "schedule", "podcast", podcast.Path)
+	start := time.Now()
+	if err := s.refresh(ctx, podcast); err != nil {
+		logger.Warn("Failed to refresh podcast", "err", err)
+	} else {
+		logger.Info("Refreshed podcast", "duration", time.Since(start))
+	}
+	return refreshGap
+}
+
+// run refreshes the podcasts until the context is done
+func (s *scheduler) run(ctx context.Context) {
+	if len(s.podcasts) == 0 {
+		return
+	}
+	for {
+		timer := time.NewTimer(s.step(ctx))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// channel returns the latest channel scraped for the podcast, its items
+// are copied so that they can be changed
+func (s *scheduler) channel(podcast Podcast) (Channel, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.channels[podcast.Path]
+	if ok {
+		channel.Items = append([]Item(nil), channel.Items...)
+	}
+	return channel, ok
+}
+
+type schedulerKey struct{}
+
+// withScheduler scrapes the podcasts with the context from the channels
+// kept by the scheduler, nil scrapes radiocity
+func withScheduler(ctx context.Context, s *scheduler) context.Context {
+	return context.WithValue(ctx, schedulerKey{}, s)
+}
+
+// schedulerFrom returns the scheduler of the context, nil when podcasts
+// are scraped on request
+func schedulerFrom(ctx context.Context) *scheduler {
+	s, _ := ctx.Value(schedulerKey{}).(*scheduler)
+	return s
+}
+
+// feedBuilder builds the feeds from the channels kept
+func (s *scheduler) feedBuilder(builder FeedBuilder) FeedBuilder {
+	return func(ctx context.Context, podcast Podcast, selfLink AtomLink) (RSS, error) {
+		return builder(withScheduler(ctx, s), podcast, selfLink)
+	}
+}
+
+// masterBuilder merges the items of the channels kept
+func (s *scheduler) masterBuilder(master MasterFeedBuilder) MasterFeedBuilder {
+	return func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		return master(withScheduler(ctx, s), podcasts, selfLink)
+	}
+}
+
+// ServeHTTP responds with the refresh state of the podcasts as json
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type status struct {
+		Podcast string `json:"podcast"`
+		podcastRefresh
+		Interval string `json:"interval"`
+	}
+	s.mu.Lock()
+	statuses := make([]status, 0, len(s.podcasts))
+	for _, podcast := range s.podcasts {
+		statuses = append(statuses, status{podcast.Path, *s.state[podcast.Path], s.settings.interval(podcast).String()})
+	}
+	s.mu.Unlock()
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Next.Before(statuses[j].Next) })
+	buf, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode refresh state", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(buf, '\n'))
+}
+
+// validateRefresh reports the refresh settings which cannot be used
+func validateRefresh(config Config) []string {
+	var problems []string
+	check := func(name, interval string) {
+		if interval == "" {
+			return
+		}
+		if d, err := time.ParseDuration(interval); err != nil || d < minRefreshInterval {
+			problems = append(problems, fmt.Sprintf("%s: refresh interval %q is not a duration of at least %s", name, interval, minRefreshInterval))
+		}
+	}
+	if r := config.Refresh; r != nil {
+		check("refresh", r.Interval)
+		if r.Jitter < 0 || r.Jitter >= 1 {
+			problems = append(problems, fmt.Sprintf("refresh: jitter %g is not between 0 and 1", r.Jitter))
+		}
+		if _, err := parseQuietHours(r.QuietHours); err != nil {
+			problems = append(problems, "refresh: "+err.Error())
+		}
+	}
+	for _, podcast := range config.Podcasts {
+		check(podcast.Path, podcast.Refresh)
+	}
+	return problems
+}
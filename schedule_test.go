@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", "2020-03-10 "+clock, istLocation)
+		return t
+	}
+	tests := []struct {
+		hours, at string
+		quiet     bool
+		end       time.Time
+	}{
+		{"01:00-06:00", "00:59", false, time.Time{}},
+		{"01:00-06:00", "01:00", true, at("06:00")},
+		{"01:00-06:00", "05:59", true, at("06:00")},
+		{"01:00-06:00", "06:00", false, time.Time{}},
+		{"22:30-02:00", "23:00", true, at("02:00").AddDate(0, 0, 1)},
+		{"22:30-02:00", "01:00", true, at("02:00")},
+		{"22:30-02:00", "12:00", false, time.Time{}},
+		{"", "03:00", false, time.Time{}},
+	}
+	for _, test := range tests {
+		q, err := parseQuietHours(test.hours)
+		if err != nil {
+			t.Fatalf("Failed to parse %s\n%q", test.hours, err)
+		}
+		end, quiet := q.end(at(test.at))
+		if quiet != test.quiet || (quiet && !end.Equal(test.end)) {
+			t.Errorf("Expected %s in %s to be quiet %v until %v but was %v until %v", test.at, test.hours, test.quiet, test.end, quiet, end)
+		}
+	}
+	for _, hours := range []string{"1-6", "25:00-06:00", "01:00-06:60"} {
+		if _, err := parseQuietHours(hours); err == nil {
+			t.Errorf("Expected %s not to parse", hours)
+		}
+	}
+}
+
+func TestNextRefresh(t *testing.T) {
+	quiet, _ := parseQuietHours("01:00-06:00")
+	s := &scheduler{settings: Refresh{Interval: "1h"}, quiet: quiet, random: func() float64 { return 0.5 }}
+	noon, _ := time.ParseInLocation("2006-01-02 15:04", "2020-03-10 12:00", istLocation)
+	day := 24 * time.Hour
+	tests := []struct {
+		name    string
+		podcast Podcast
+		state   podcastRefresh
+		at      time.Time
+		next    time.Duration
+	}{
+		{"interval", Podcast{}, podcastRefresh{Latest: noon.Add(-day)}, noon, time.Hour},
+		{"podcast interval", Podcast{Refresh: "3h"}, podcastRefresh{}, noon, 3 * time.Hour},
+		{"first failure", Podcast{}, podcastRefresh{Failures: 1}, noon, 5 * time.Minute},
+		{"third failure", Podcast{}, podcastRefresh{Failures: 3}, noon, 20 * time.Minute},
+		{"failing", Podcast{}, podcastRefresh{Failures: 10}, noon, time.Hour},
+		{"two months", Podcast{}, podcastRefresh{Latest: noon.Add(-70 * day)}, noon, 2 * time.Hour},
+		{"three months", Podcast{}, podcastRefresh{Latest: noon.Add(-100 * day)}, noon, 4 * time.Hour},
+		{"a year", Podcast{}, podcastRefresh{Latest: noon.Add(-365 * day)}, noon, 24 * time.Hour},
+		{"quiet hours", Podcast{}, podcastRefresh{}, noon.Add(12*time.Hour + 30*time.Minute), 5*time.Hour + 30*time.Minute + 3*time.Minute},
+	}
+	for _, test := range tests {
+		if got := s.next(test.podcast, test.state, test.at).Sub(test.at); got != test.next {
+			t.Errorf("%s: expected the next refresh in %v but was in %v", test.name, test.next, got)
+		}
+	}
+
+	s.random = func() float64 { return 0 }
+	if got := s.next(Podcast{}, podcastRefresh{}, noon).Sub(noon); got != 54*time.Minute {
+		t.Errorf("Expected the refresh to be jittered by 10%% but was in %v", got)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	fake := newFakeRadioCity(t)
+	defer func(gap time.Duration) { refreshGap = gap }(refreshGap)
+	refreshGap = 0
+	ctx := context.Background()
+	config := Config{
+		Podcasts: podcasts[:2],
+		Refresh:  &Refresh{Interval: "2h", State: filepath.Join(t.TempDir(), "refresh.json")},
+	}
+	if problems := validateRefresh(config); len(problems) != 0 {
+		t.Fatalf("Expected the refresh config to be valid but was %v", problems)
+	}
+	s, err := newScheduler(config)
+	if err != nil {
+		t.Fatalf("Failed to create scheduler\n%q", err)
+	}
+	start := now()
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return start.Add(startupSpread) }
+	for i := 0; i < len(config.Podcasts); i++ {
+		if wait := s.step(ctx); wait != 0 {
+			t.Fatalf("Expected the podcasts to be due at the start but the next was in %v", wait)
+		}
+	}
+	if wait := s.step(ctx); wait < 108*time.Minute {
+		t.Errorf("Expected the next refresh in about 2h but was in %v", wait)
+	}
+
+	// the feeds are built from the refreshed channels
+	requests := len(fake.Requests())
+	mux := newServeMux(config, s.feedBuilder(scrapeFeed), s.masterBuilder(buildFeed))
+	mux.Handle(scheduleRoute, s)
+	for _, path := range []string{config.Podcasts[0].Path, "/master"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://feeds.example.com"+path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<item>") {
+			t.Errorf("Expected %s to be served from the refreshed channels but was %d", path, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `href="http://feeds.example.com`+path+`"`) {
+			t.Errorf("Expected %s to link itself", path)
+		}
+	}
+	if len(fake.Requests()) != requests {
+		t.Errorf("Expected no request to radiocity but made %v", fake.Requests()[requests:])
+	}
+
+	// a failed refresh keeps the channel and is retried sooner
+	podcast := config.Podcasts[0]
+	fake.set(func(f *fakeRadioCity) {
+		f.Status["www.radiocity.in"+strings.TrimPrefix(podcast.URL, "https://www.radiocity.in")] = 500
+	})
+	if err := s.refresh(ctx, podcast); err == nil {
+		t.Fatalf("Expected the refresh to fail")
+	}
+	if _, ok := s.channel(podcast); !ok {
+		t.Errorf("Expected the channel to be kept when the refresh fails")
+	}
+	reloaded, err := newScheduler(config)
+	if err != nil {
+		t.Fatalf("Failed to reload scheduler\n%q", err)
+	}
+	st := reloaded.state[podcast.Path]
+	if st.Failures != 1 || st.LastSuccess.IsZero() || st.Latest.IsZero() {
+		t.Errorf("Expected the refresh state to be kept but was %+v", st)
+	}
+	if next := s.state[podcast.Path].Next; !st.Next.Equal(next) {
+		t.Errorf("Expected the restart to keep the next refresh at %v but was %v", next, st.Next)
+	}
+	if _, at := reloaded.due(); !at.After(now()) {
+		t.Errorf("Expected no podcast to be due after a restart but one was due at %v", at)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://feeds.example.com/schedule", nil))
+	if !strings.Contains(w.Body.String(), `"failures": 1`) || !strings.Contains(w.Body.String(), `"interval": "2h0m0s"`) {
+		t.Errorf("Expected the schedule to list the refresh state but was %s", w.Body.String())
+	}
+}
+
+func TestValidateRefresh(t *testing.T) {
+	config := Config{
+		Podcasts: []Podcast{{Path: "/cd", Refresh: "1m"}},
+		Refresh:  &Refresh{Interval: "often", Jitter: 1.5, QuietHours: "late"},
+	}
+	if problems := validateRefresh(config); len(problems) != 4 {
+		t.Errorf("Expected 4 problems but were %v", problems)
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"mime"
 	"net/http"
 	"net/url"
@@ -18,70 +18,137 @@ import (
 	"github.com/pkg/errors"
 )
 
-func getEnclosure(in <-chan Item, out chan<- Item, errs chan<- error, done chan<- bool) {
-	logger := log.New(os.Stderr, "[scrape][enclosure] ", 0)
-	for item := range in {
+func init() {
+	// not every system has a mime table which knows about audio
+	mime.AddExtensionType(".mp3", "audio/mpeg")
+	mime.AddExtensionType(".m4a", "audio/mp4")
+}
+
+// getEnclosure fills in the enclosure of the items at the indexes it
+// receives. A media url which cannot be loaded is logged and leaves the
+// enclosure length unknown.
+func getEnclosure(ctx context.Context, items []Item, in <-chan int, done chan<- bool) {
+	logger := loggerFrom(ctx).With("component", "scrape.enclosure")
+	for i := range in {
+		item := &items[i]
 		start := time.Now()
-		res, err := http.Head(item.Link.String())
-		if err != nil {
-			errs <- errors.Wrapf(err, "Failed to load media url %s", item.Link.String())
-		}
 		length := 0
-		if res.StatusCode == http.StatusOK {
-			ls := res.Header.Get("Content-Length")
-			length, _ = strconv.Atoi(ls)
+		res, err := headUrl(ctx, item.Link.String())
+		if err != nil {
+			logger.Warn("Failed to load media url", "url", item.Link.String(), "err", err)
+		} else {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				ls := res.Header.Get("Content-Length")
+				length, _ = strconv.Atoi(ls)
+			} else {
+				logger.Warn("Unexpected media url status", "url", item.Link.String(), "status", res.StatusCode)
+			}
 		}
 		item.Enclosure = Enclosure{
 			URL:    item.Link,
 			Type:   mime.TypeByExtension(path.Ext(item.Link.Path)),
 			Length: length,
 		}
-		logger.Printf("Loaded enclosure in %s", time.Since(start).String())
-		out <- item
+		logger.Debug("Loaded enclosure", "url", item.Link.String(), "length", length, "duration", time.Since(start))
 	}
 	done <- true
 }
 
-// extractItems extracts a list of items from a parsed document
-func extractItems(doc *goquery.Document, imgUrl URL, categories []string) ([]Item, error) {
+// istLocation is the zone the episode dates on radiocity are in
+var istLocation = loadIST()
+
+func loadIST() *time.Location {
+	if loc, err := time.LoadLocation("Asia/Kolkata"); err == nil {
+		return loc
+	}
+	return time.FixedZone("IST", 5*60*60+30*60)
+}
+
+// splitPodName splits episode names such as
+//
+//	Crime Diary EP 38 - Investigation on Mariappan`s Murder case - October 29, 2018
+//
+// into the title, the description and the publish date. The date is only
+// split off when the last part is a date, ok reports whether it was. The
+// title is split off at the first spaced dash, or the first dash when
+// there is none, and stands in for a missing description and vice versa.
+func splitPodName(name string) (title, desc string, date time.Time, ok bool) {
+	name = strings.TrimSpace(name)
+	rest := name
+	if di := strings.LastIndex(rest, "-"); di != -1 {
+		if d, err := time.ParseInLocation("January 2, 2006", strings.TrimSpace(rest[di+1:]), istLocation); err == nil {
+			date, ok = d, true
+			if rest = strings.TrimSpace(rest[:di]); rest == "" {
+				rest = name
+			}
+		}
+	}
+	title, desc = rest, rest
+	fi, sep := strings.Index(rest, " - "), len(" - ")
+	if fi == -1 {
+		fi, sep = strings.Index(rest, "-"), len("-")
+	}
+	if fi != -1 {
+		title = strings.TrimSpace(rest[:fi])
+		desc = strings.TrimSpace(rest[fi+sep:])
+	}
+	if title == "" {
+		title = desc
+	}
+	if desc == "" {
+		desc = title
+	}
+	return title, desc, date, ok
+}
+
+// pageLink is the canonical link of the show page, or the podcast page
+// when the canonical link is missing or fails to parse
+func pageLink(ctx context.Context, doc *goquery.Document, podcast Podcast) URL {
+	page, err := canonicalLink(doc, podcast.URL)
+	if err != nil {
+		loggerFrom(ctx).Warn("Failed to parse canonical link, using the podcast page", "podcast", podcast.Path, "err", err)
+		page, _ = normalizeURL(podcast.URL, nil)
+	}
+	return page
+}
+
+// extractItems extracts a list of items from a parsed document, links are
+// resolved against the page and episodes without artwork of their own use
+// the podcast image. modified is the Last-Modified time of the page, zero
+// when unknown.
+func extractItems(ctx context.Context, doc *goquery.Document, page URL, modified time.Time, imgUrl URL, categories []string) ([]Item, error) {
 	var items []Item
-	logger := log.New(os.Stderr, "[scrape][item] ", 0)
+	logger := loggerFrom(ctx).With("component", "scrape.item")
 	start := time.Now()
-	IST, _ := time.LoadLocation("Asia/Kolkata")
+	base := url.URL(page)
+	var undated []bool
 	doc.Find(".podcast_button a").Each(func(i int, pi *goquery.Selection) {
 		descStr := pi.AttrOr("data-podname", "")
 		link := strings.TrimSpace(pi.AttrOr("data-podcast", ""))
-		pd := time.Now()
-		title, desc := descStr, descStr
-		if descStr != "" {
-			di := strings.LastIndex(descStr, "-")
-			if di != -1 {
-				dateStr := strings.TrimSpace(descStr[di+1:])
-				pd, _ = time.ParseInLocation("January 2, 2006", dateStr, IST)
-				if pd.IsZero() {
-					fmt.Println("Failed to parse", dateStr)
-				}
-			}
-			fi := strings.Index(descStr, "-")
-			if fi != -1 {
-				title = strings.TrimSpace(descStr[0:fi])
-				if fi < di {
-					desc = strings.TrimSpace(descStr[fi+1 : di])
-				} else {
-					desc = title
-				}
+		title, desc, pd, ok := splitPodName(descStr)
+		if !ok {
+			if descStr != "" {
+				logger.Warn("Failed to parse publish date", "name", descStr)
 			}
 		}
-		linkUrl, err := parseURL(link)
+		linkUrl, err := normalizeURL(link, &base)
 		if err != nil {
-			fmt.Printf("Failed to parse link %s", link)
+			logger.Warn("Failed to parse link", "link", link, "err", err)
+		}
+		itemImg := imgUrl
+		if src := episodeImage(pi); src != "" {
+			if itemImg, err = normalizeURL(src, &base); err != nil {
+				logger.Warn("Failed to parse episode image url", "url", src, "err", err)
+				itemImg = imgUrl
+			}
 		}
 
 		item := Item{
 			Title:       title,
 			Description: desc,
 			Link:        linkUrl,
-			ItunesImage: ItunesImage{URL: imgUrl},
+			ItunesImage: ItunesImage{URL: itemImg},
 			PublishDate: XMLDate(pd),
 			GUID: GUID{
 				Value: link,
@@ -90,153 +157,219 @@ func extractItems(doc *goquery.Document, imgUrl URL, categories []string) ([]Ite
 		}
 		if item.Description != "" && item.Link.RequestURI() != "" {
 			items = append(items, item)
+			undated = append(undated, !ok)
 		}
 	})
-	logger.Printf("Item parsing completed in %s\n", time.Since(start).String())
-	in := make(chan Item)
-	out := make(chan Item)
-	errs := make(chan error)
+	dateUndated(items, undated, pageDate(modified))
+	logger.Debug("Item parsing completed", "items", len(items), "duration", time.Since(start))
+	if c := artworkFrom(ctx); c != nil {
+		c.verifyArtwork(ctx, imgUrl, items)
+	}
+	in := make(chan int)
 	done := make(chan bool)
 	workerCount, err := strconv.Atoi(os.Getenv("WC_COUNT"))
 	if err != nil {
 		workerCount = 10
 	}
-	if workerCount < 0 {
+	if workerCount < 1 {
 		workerCount = 10
 	}
 	if workerCount > 1 {
-		logger.Printf("Using %d workers", workerCount)
+		logger.Debug("Using enclosure workers", "workers", workerCount)
 	}
-	doneCount := 0
+	// items keep their order on the page however long each enclosure takes
 	for i := 0; i < workerCount; i++ {
-		go getEnclosure(in, out, errs, done)
+		go getEnclosure(ctx, items, in, done)
 	}
 	go func() {
-		for _, item := range items {
-			in <- item
+		for i := range items {
+			in <- i
 		}
 		close(in)
 	}()
-	var eItems []Item
-	for {
-		select {
-		case item, more := <-out:
-			if more {
-				eItems = append(eItems, item)
-			} else {
-				logger.Printf("Item enclosures completed in %s\n", time.Since(start).String())
-				return eItems, nil
-			}
-		case <-done:
-			doneCount++
-			if doneCount >= workerCount {
-				close(out)
-			}
-		case err := <-errs:
-			return items, err
-		}
+	for doneCount := 0; doneCount < workerCount; doneCount++ {
+		<-done
 	}
+	logger.Debug("Item enclosures completed", "items", len(items), "duration", time.Since(start))
 	return items, nil
 }
 
+// dateUndated dates the items whose date could not be parsed like the item
+// before them on the page, or the one after them for the first items, so
+// that rebuilds of an unchanged page are identical. When no item has a date
+// they are all dated fallback.
+func dateUndated(items []Item, undated []bool, fallback time.Time) {
+	var previous XMLDate
+	for i := range items {
+		if !undated[i] {
+			previous = items[i].PublishDate
+			continue
+		}
+		items[i].PublishDate = previous
+	}
+	var next XMLDate
+	for i := len(items) - 1; i >= 0; i-- {
+		if !undated[i] {
+			next = items[i].PublishDate
+			continue
+		}
+		if time.Time(items[i].PublishDate).IsZero() {
+			items[i].PublishDate = next
+		}
+		if time.Time(items[i].PublishDate).IsZero() {
+			items[i].PublishDate = XMLDate(fallback)
+		}
+	}
+}
+
+// pageDate dates a page by its Last-Modified header, or the start of the
+// day when it has none so that the episodes of a page without dates keep
+// their date for the day
+func pageDate(modified time.Time) time.Time {
+	if !modified.IsZero() {
+		return modified.In(istLocation)
+	}
+	y, m, d := now().In(istLocation).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, istLocation)
+}
+
 // getChannel builds a channel from scraped podcast url buffer
-func getChannel(podcast Podcast, selfLink AtomLink, buf []byte) (Channel, error) {
+func getChannel(ctx context.Context, podcast Podcast, selfLink AtomLink, buf []byte, modified time.Time) (Channel, error) {
 	channel := Channel{}
 	start := time.Now()
-	logger := log.New(os.Stderr, "[scrape][channel] ", 0)
+	logger := loggerFrom(ctx).With("component", "scrape.channel")
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(buf))
 	if err != nil {
 		return channel, err
 	}
 	channel.Title = doc.Find(".pod_desc_txt h1").First().Text()
 	channel.Description = doc.Find(`.pod_desc_txt p`).First().Text()
-	urlStr := doc.Find(`link[rel="canonical"]`).First().AttrOr("href", "")
-	if strings.HasPrefix(urlStr, "//") {
-		urlStr = "http:" + urlStr
-	}
-	channelLink, err := url.Parse(urlStr)
-	if err != nil {
-		return channel, errors.Wrapf(err, "Failed to parse url %s", urlStr)
-	}
-	channel.Link = URL(*channelLink)
+	channelLink := pageLink(ctx, doc, podcast)
+	channel.Link = channelLink
 	channel.AtomLink = selfLink
-	channel.LastBuildDate = XMLDate(time.Now())
-	channel.PublishDate = XMLDate(time.Now())
+	channel.Language = languageCode(podcast.Language)
+	channel.ItunesExplicit = explicitValue(podcast.Explicit)
+	channel.ItunesCategories = itunesCategories(podcast.Categories)
+	describePodcast(&channel, podcast)
+	channel.LastBuildDate = XMLDate(now())
+	channel.PublishDate = XMLDate(now())
 
 	if imgUrl, ok := doc.Find(".pod_desc_img img").First().Attr("src"); ok {
-		img, err := url.Parse(imgUrl)
+		base := url.URL(channelLink)
+		img, err := normalizeURL(imgUrl, &base)
 		if err != nil {
 			return channel, errors.Wrapf(err, "Failed to parse image url %s", imgUrl)
 		}
 		channel.Image = Image{
 			Title: channel.Title,
 			Link:  channel.Link,
-			URL:   URL(*img),
+			URL:   img,
 		}
 		channel.ItunesImage = ItunesImage{URL: channel.Image.URL}
 	}
-	logger.Printf("Scraped channel info in %s\n", time.Since(start).String())
-	if channel.Items, err = extractItems(doc, channel.Image.URL, podcast.Categories); err != nil {
-		logger.Printf("Scraped channel items in %s\n", time.Since(start).String())
+	logger.Debug("Scraped channel info", "duration", time.Since(start))
+	if channel.Items, err = extractItems(ctx, doc, channelLink, modified, channel.Image.URL, podcast.Categories); err != nil {
 		return channel, err
 	}
+	addEpisodes(channel.Items, podcast)
+	logger.Info("Scraped channel items", "items", len(channel.Items), "duration", time.Since(start))
 
 	return channel, nil
 }
 
 // getItems returns a list of items from the given podcast from a buffer
-func getItems(podcast Podcast, buf []byte) ([]Item, error) {
+func getItems(ctx context.Context, podcast Podcast, buf []byte, modified time.Time) ([]Item, error) {
 	var items []Item
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(buf))
 	if err != nil {
 		return items, err
 	}
-	imgUrl, err := parseURL(podcast.Image)
+	imgUrl, err := normalizeURL(podcast.Image, nil)
 	if err != nil {
-		fmt.Printf("Failed to parse image url %s", podcast.Image)
+		loggerFrom(ctx).Warn("Failed to parse image url", "url", podcast.Image, "err", err)
+	}
+	if items, err = extractItems(ctx, doc, pageLink(ctx, doc, podcast), modified, imgUrl, podcast.Categories); err != nil {
+		return items, err
 	}
-	return extractItems(doc, imgUrl, podcast.Categories)
+	addEpisodes(items, podcast)
+	return items, nil
 }
 
 // scrapeChannel builds a new channel with the items scraped from the podcast
-func scrapeChannel(podcast Podcast, selfLink AtomLink) (Channel, error) {
+func scrapeChannel(ctx context.Context, podcast Podcast, selfLink AtomLink) (Channel, error) {
+	if s := schedulerFrom(ctx); s != nil {
+		if channel, ok := s.channel(podcast); ok {
+			channel.AtomLink = selfLink
+			return channel, nil
+		}
+	}
 	channel := Channel{}
-	logger := log.New(os.Stdout, "[scrape] ", 0)
+	ctx = withLogger(ctx, loggerFrom(ctx).With("podcast", podcast.Path))
 	start := time.Now()
-	buf, err := loadUrl(podcast.URL)
+	buf, modified, err := loadPage(ctx, podcast.URL)
 	if err != nil {
 		return channel, errors.Wrap(err, "Failed to load podcast url")
 	}
-	duration := time.Since(start)
-	logger.Printf("Loaded %s in %s\n", podcast.Name, duration.String())
-	return getChannel(podcast, selfLink, buf)
+	loggerFrom(ctx).Info("Loaded podcast page", "component", "scrape", "name", podcast.Name, "duration", time.Since(start))
+	return getChannel(ctx, podcast, selfLink, buf, modified)
 }
 
 // scrapeItem builds a list of items by scraping the podcast url
-func scrapeItems(podcast Podcast) ([]Item, error) {
-	buf, err := loadUrl(podcast.URL)
+func scrapeItems(ctx context.Context, podcast Podcast) ([]Item, error) {
+	if s := schedulerFrom(ctx); s != nil {
+		if channel, ok := s.channel(podcast); ok {
+			return channel.Items, nil
+		}
+	}
+	ctx = withLogger(ctx, loggerFrom(ctx).With("podcast", podcast.Path))
+	buf, modified, err := loadPage(ctx, podcast.URL)
 	if err != nil {
 		return []Item{}, errors.Wrap(err, "Failed to load podcast url")
 	}
-	return getItems(podcast, buf)
+	return getItems(ctx, podcast, buf, modified)
 }
 
-func loadUrl(url string) ([]byte, error) {
-	res, err := http.Get(url)
+// httpClient is shared by every request made to radiocity
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+func headUrl(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	return httpClient.Do(req)
+}
+
+func loadUrl(ctx context.Context, url string) ([]byte, error) {
+	buf, _, err := loadPage(ctx, url)
+	return buf, err
+}
+
+// loadPage loads the url along with its Last-Modified time, zero when the
+// response has none
+func loadPage(ctx context.Context, url string) ([]byte, time.Time, error) {
+	var modified time.Time
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, modified, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, modified, err
+	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("%s returned status code %d", url, res.StatusCode)
+		return nil, modified, fmt.Errorf("%s returned status code %d", url, res.StatusCode)
 	}
 	buf, err := ioutil.ReadAll(res.Body)
-	//fmt.Println("loadUrl", buf, err)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to read response body")
+		return nil, modified, errors.Wrapf(err, "Failed to read response body")
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		modified = t
 	}
-	return buf, nil
+	return buf, modified, nil
 }
 
-type FeedBuilder func(Podcast, AtomLink) (RSS, error)
-type MasterFeedBuilder func([]Podcast, AtomLink) (RSS, error)
+type FeedBuilder func(context.Context, Podcast, AtomLink) (RSS, error)
+type MasterFeedBuilder func(context.Context, []Podcast, AtomLink) (RSS, error)
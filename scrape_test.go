@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDateUndated(t *testing.T) {
+	day := func(d int) XMLDate { return XMLDate(time.Date(2018, 10, d, 0, 0, 0, 0, istLocation)) }
+	items := []Item{{}, {PublishDate: day(9)}, {}, {PublishDate: day(5)}, {}}
+	dateUndated(items, []bool{true, false, true, false, true}, time.Time(day(1)))
+	for i, want := range []XMLDate{day(9), day(9), day(9), day(5), day(5)} {
+		if !time.Time(items[i].PublishDate).Equal(time.Time(want)) {
+			t.Errorf("Expected item %d to be dated %v but was %v", i, time.Time(want), time.Time(items[i].PublishDate))
+		}
+	}
+
+	// a page without any dates
+	items = []Item{{}, {}}
+	dateUndated(items, []bool{true, true}, time.Time(day(1)))
+	for i, item := range items {
+		if !time.Time(item.PublishDate).Equal(time.Time(day(1))) {
+			t.Errorf("Expected item %d to be dated like the page but was %v", i, time.Time(item.PublishDate))
+		}
+	}
+}
+
+func TestPageDate(t *testing.T) {
+	modified := time.Date(2018, 10, 9, 6, 30, 0, 0, time.UTC)
+	if got := pageDate(modified); !got.Equal(modified) {
+		t.Errorf("Expected the page to be dated by its Last-Modified %v but was %v", modified, got)
+	}
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return time.Date(2018, 10, 9, 20, 0, 0, 0, time.UTC) }
+	// 20:00 UTC is already the next day in IST
+	if got, want := pageDate(time.Time{}), time.Date(2018, 10, 10, 0, 0, 0, 0, istLocation); !got.Equal(want) {
+		t.Errorf("Expected a page without Last-Modified to be dated %v but was %v", want, got)
+	}
+}
+
+func TestBadCanonicalLink(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	podcast := podcasts[0]
+	buf, err := ioutil.ReadFile("testdata/cd.html")
+	if err != nil {
+		t.Fatalf("Failed to read show page\n%q", err)
+	}
+	page := strings.Replace(string(buf), "//www.radiocity.in/radiocity/show-podcasts-tamil/Crime-Diary/153", "http://[radiocity", 1)
+	ctx := context.Background()
+	items, err := getItems(ctx, podcast, []byte(page), time.Time{})
+	if err != nil || len(items) == 0 {
+		t.Fatalf("Expected the episodes of a page with a bad canonical link but were %d\n%v", len(items), err)
+	}
+	channel, err := getChannel(ctx, podcast, NewAtomLink("http://localhost:8080"+podcast.Path), []byte(page), time.Time{})
+	if err != nil || channel.Link.String() != podcast.URL {
+		t.Errorf("Expected the channel to link the podcast page but was %s\n%v", channel.Link.String(), err)
+	}
+}
+
+func TestUndatedPage(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	buf, err := ioutil.ReadFile("testdata/cd.html")
+	if err != nil {
+		t.Fatalf("Failed to read show page\n%q", err)
+	}
+	page := regexp.MustCompile(` - [A-Z][a-z]+ [0-9]+, [0-9]{4}"`).ReplaceAllString(string(buf), `"`)
+	modified := time.Date(2018, 11, 2, 10, 0, 0, 0, time.UTC)
+	items, err := getItems(context.Background(), podcasts[0], []byte(page), modified)
+	if err != nil || len(items) == 0 {
+		t.Fatalf("Expected the episodes of a page without dates but were %d\n%v", len(items), err)
+	}
+	for _, item := range items {
+		if !time.Time(item.PublishDate).Equal(modified) {
+			t.Errorf("Expected %q to be dated by the page %v but was %v", item.Title, modified, time.Time(item.PublishDate))
+		}
+	}
+}
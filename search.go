@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	searchRoute = "/search"
+	// searchTTL is how long the index is used before the episodes are
+	// indexed again
+	searchTTL = 15 * time.Minute
+	// maxSearchResults is the number of results without a limit
+	maxSearchResults = 50
+	// titleWeight is how much more a term in the title counts than one in
+	// the description
+	titleWeight = 3
+	// minPrefix is the least number of characters a search term needs to
+	// match the words it starts. Hindi and Tamil attach case endings to
+	// the words, eg. கொலையில் is கொலை (murder) with the ending இல் (in).
+	minPrefix = 3
+	// prefixWeight is how much a word the term starts counts
+	prefixWeight = 0.5
+)
+
+const (
+	zeroWidthJoiner    = '\u200d'
+	zeroWidthNonJoiner = '\u200c'
+	devanagariNukta    = '\u093c'
+	chandrabindu       = '\u0901'
+	anusvara           = '\u0902'
+	// the Devanagari consonants precomposed with a nukta, क़ to य़
+	firstNuktaLetter = '\u0958'
+	lastNuktaLetter  = '\u095f'
+	devanagariZero   = '\u0966'
+	devanagariNine   = '\u096f'
+	tamilZero        = '\u0be6'
+	tamilNine        = '\u0bef'
+)
+
+// nuktaLetters are the consonants of the letters precomposed with a
+// nukta. Hindi is written with and without the nukta so it is ignored.
+var nuktaLetters = []rune{'क', 'ख', 'ग', 'ज', 'ड', 'ढ', 'फ', 'य'}
+
+// stopWords are not indexed, they are in most titles and descriptions
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "the": true, "of": true, "in": true, "on": true, "is": true,
+	"to": true, "for": true, "with": true, "by": true, "at": true, "from": true,
+	"का": true, "की": true, "के": true, "को": true, "में": true, "है": true, "हैं": true,
+	"और": true, "से": true, "पर": true, "ने": true, "एक": true, "यह": true,
+	"ஒரு": true, "மற்றும்": true, "இந்த": true, "அந்த": true,
+}
+
+// isWordRune reports whether the rune is part of a word. The vowel signs
+// and viramas of Devanagari and Tamil are marks, not letters.
+func isWordRune(r rune) bool {
+	switch r {
+	case zeroWidthJoiner, zeroWidthNonJoiner, '\'', '`', '’':
+		return true
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// normalizeToken lower cases the word, drops possessives, joiners and
+// nuktas, spells chandrabindu as anusvara and Devanagari and Tamil digits
+// as ascii digits
+func normalizeToken(word string) string {
+	word = strings.ToLower(word)
+	for _, possessive := range []string{"'s", "`s", "’s"} {
+		word = strings.TrimSuffix(word, possessive)
+	}
+	var b strings.Builder
+	for _, r := range word {
+		switch {
+		case r == zeroWidthJoiner || r == zeroWidthNonJoiner || r == '\'' || r == '`' || r == '’' || r == devanagariNukta:
+			continue
+		case r >= firstNuktaLetter && r <= lastNuktaLetter:
+			r = nuktaLetters[r-firstNuktaLetter]
+		case r == chandrabindu:
+			r = anusvara
+		case r >= devanagariZero && r <= devanagariNine:
+			r = '0' + r - devanagariZero
+		case r >= tamilZero && r <= tamilNine:
+			r = '0' + r - tamilZero
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// tokenize splits the text into normalized words, leaving out stop words
+func tokenize(text string) []string {
+	var tokens []string
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !isWordRune(r) }) {
+		if token := normalizeToken(word); token != "" && !stopWords[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// searchDoc is an indexed episode
+type searchDoc struct {
+	Podcast Podcast
+	Item    Item
+}
+
+// posting is a document a term is in, weighted by how often and where
+type posting struct {
+	doc    int
+	weight float64
+}
+
+// searchIndex is an inverted index of the titles and descriptions of the
+// episodes
+type searchIndex struct {
+	docs     []searchDoc
+	postings map[string][]posting
+	// terms are sorted to look up the terms starting with a prefix
+	terms []string
+}
+
+func newSearchIndex(docs []searchDoc) *searchIndex {
+	ix := &searchIndex{docs: docs, postings: make(map[string][]posting)}
+	for i, doc := range docs {
+		weights := make(map[string]float64)
+		for _, token := range tokenize(doc.Item.Title) {
+			weights[token] += titleWeight
+		}
+		for _, token := range tokenize(doc.Item.Description) {
+			weights[token]++
+		}
+		for token, weight := range weights {
+			ix.postings[token] = append(ix.postings[token], posting{doc: i, weight: weight})
+		}
+	}
+	for term := range ix.postings {
+		ix.terms = append(ix.terms, term)
+	}
+	sort.Strings(ix.terms)
+	return ix
+}
+
+// matches scores the documents with the term or, for long enough terms,
+// with words starting with it. Rare terms score higher.
+func (ix *searchIndex) matches(term string) map[int]float64 {
+	scores := make(map[int]float64)
+	add := func(t string, factor float64) {
+		postings := ix.postings[t]
+		idf := math.Log(1 + float64(len(ix.docs))/float64(len(postings)))
+		for _, p := range postings {
+			scores[p.doc] += factor * p.weight * idf
+		}
+	}
+	if _, ok := ix.postings[term]; ok {
+		add(term, 1)
+	}
+	if utf8.RuneCountInString(term) >= minPrefix {
+		for i := sort.SearchStrings(ix.terms, term); i < len(ix.terms) && strings.HasPrefix(ix.terms[i], term); i++ {
+			if ix.terms[i] != term {
+				add(ix.terms[i], prefixWeight)
+			}
+		}
+	}
+	return scores
+}
+
+// searchResult is a matching episode and its score
+type searchResult struct {
+	searchDoc
+	Score float64
+}
+
+// search returns the episodes matching every term of the query, the best
+// matches first and the newest of equal ones, in the order of the feed
+func (ix *searchIndex) search(query string) []searchResult {
+	var scores map[int]float64
+	seen := make(map[string]bool)
+	for _, term := range tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		matched := ix.matches(term)
+		if scores == nil {
+			scores = matched
+			continue
+		}
+		for doc := range scores {
+			if score, ok := matched[doc]; ok {
+				scores[doc] += score
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+	results := make([]searchResult, 0, len(scores))
+	for doc := range ix.docs {
+		if score, ok := scores[doc]; ok {
+			results = append(results, searchResult{searchDoc: ix.docs[doc], Score: score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return time.Time(results[i].Item.PublishDate).After(time.Time(results[j].Item.PublishDate))
+	})
+	return results
+}
+
+// searcher indexes the items of the master feed and serves the searches
+type searcher struct {
+	podcasts []Podcast
+	master   MasterFeedBuilder
+
+	mu      sync.Mutex
+	index   *searchIndex
+	channel Channel
+	built   time.Time
+	// rebuilt is closed once the rebuild in progress is done, nil when no
+	// rebuild is running
+	rebuilt chan struct{}
+}
+
+func newSearcher(podcasts []Podcast, master MasterFeedBuilder) *searcher {
+	return &searcher{podcasts: podcasts, master: master}
+}
+
+// current returns the index and the master channel it was built from,
+// indexing the episodes again when the index is older than searchTTL. A
+// single rebuild runs at a time, the stale index is served meanwhile and
+// only the first index is waited for.
+func (s *searcher) current(ctx context.Context, masterLink string) (*searchIndex, Channel, error) {
+	s.mu.Lock()
+	if s.index != nil && (s.rebuilt != nil || now().Sub(s.built) < searchTTL) {
+		defer s.mu.Unlock()
+		return s.index, s.channel, nil
+	}
+	if rebuilt := s.rebuilt; rebuilt != nil {
+		s.mu.Unlock()
+		select {
+		case <-rebuilt:
+		case <-ctx.Done():
+			return nil, Channel{}, ctx.Err()
+		}
+		return s.current(ctx, masterLink)
+	}
+	rebuilt := make(chan struct{})
+	s.rebuilt = rebuilt
+	s.mu.Unlock()
+
+	index, channel, err := s.build(ctx, masterLink)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rebuilt = nil
+	close(rebuilt)
+	if err != nil {
+		return nil, Channel{}, err
+	}
+	s.index, s.channel, s.built = index, channel, now()
+	return index, channel, nil
+}
+
+// build indexes the episodes of the master feed
+func (s *searcher) build(ctx context.Context, masterLink string) (*searchIndex, Channel, error) {
+	start := time.Now()
+	rss, err := s.master(ctx, s.podcasts, NewAtomLink(masterLink))
+	if err != nil {
+		return nil, Channel{}, err
+	}
+	byPath := make(map[string]Podcast)
+	for _, podcast := range s.podcasts {
+		byPath[podcast.Path] = podcast
+	}
+	var docs []searchDoc
+	for _, item := range rss.Channel.Items {
+		var podcast Podcast
+		if item.Source != nil {
+			podcast = byPath[item.Source.URL.Path]
+		}
+		docs = append(docs, searchDoc{Podcast: podcast, Item: item})
+	}
+	index := newSearchIndex(docs)
+	loggerFrom(ctx).Info("Indexed episodes", "component", "search", "episodes", len(docs), "terms", len(index.terms), "duration", time.Since(start))
+	return index, rss.Channel, nil
+}
+
+var searchTemplate = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Query}}{{.Query}} - {{end}}Search RadioCity Podcasts</title>
+{{- if .Feed}}
+<link rel="alternate" type="application/rss+xml" title="Episodes matching {{.Query}}" href="{{.Feed}}">
+{{- end}}
+</head>
+<body>
+<h1>Search RadioCity Podcasts</h1>
+<form action="/search">
+<input type="search" name="q" value="{{.Query}}" autofocus>
+<button>Search</button>
+</form>
+{{- if .Query}}
+<p>{{len .Results}} episodes{{if .Feed}}, <a href="{{.Feed}}">subscribe to the matches</a>{{end}}</p>
+<ol>
+{{- range .Results}}
+<li>
+<a href="{{.Enclosure}}">{{.Title}}</a> <small>{{.Podcast}}{{if not .Published.IsZero}}, {{.Published.Format "2 Jan 2006"}}{{end}}</small>
+{{- if .Description}}
+<p>{{.Description}}</p>
+{{- end}}
+</li>
+{{- end}}
+</ol>
+{{- end}}
+</body>
+</html>
+`))
+
+// searchHit is a result as rendered and as json
+type searchHit struct {
+	Podcast     string    `json:"podcast"`
+	Prefix      string    `json:"prefix"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	GUID        string    `json:"guid"`
+	Enclosure   string    `json:"enclosureUrl"`
+	Published   time.Time `json:"published"`
+	Score       float64   `json:"score"`
+}
+
+// searchPage is the data rendered by the search template and the json
+// response
+type searchPage struct {
+	Query   string      `json:"query"`
+	Feed    string      `json:"feed,omitempty"`
+	Results []searchHit `json:"results"`
+}
+
+// ServeHTTP searches the episodes for the q parameter. The matches are an
+// html page, json with format=json or an rss feed with format=rss, and are
+// narrowed down by the category, since, limit and lang parameters of the
+// feeds.
+func (s *searcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	format := values.Get("format")
+	if format != "" && format != "html" && format != "json" && format != "rss" {
+		http.Error(w, fmt.Sprintf("format %q is not html, json or rss", format), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseFeedFilter(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page := searchPage{Query: filter.Query, Results: []searchHit{}}
+	if filter.Query == "" && format != "" && format != "html" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	var results []searchResult
+	var channel Channel
+	if filter.Query != "" {
+		var ix *searchIndex
+		ix, channel, err = s.current(r.Context(), requestBase(r)+"/master")
+		if err != nil {
+			loggerFrom(r.Context()).Error("Failed to index episodes", "err", err)
+			http.Error(w, "Failed to index episodes", http.StatusBadGateway)
+			return
+		}
+		terms := filter
+		terms.Query = ""
+		for _, result := range ix.search(filter.Query) {
+			if terms.matchesPodcast(result.Podcast) && terms.matchesItem(result.Item) {
+				results = append(results, result)
+			}
+		}
+		limit := filter.Limit
+		if limit == 0 && format != "rss" {
+			limit = maxSearchResults
+		}
+		if limit > 0 && len(results) > limit {
+			results = results[:limit]
+		}
+		feed := url.Values{"format": {"rss"}}
+		for key, value := range filter.values() {
+			feed[key] = value
+		}
+		page.Feed = searchRoute + "?" + feed.Encode()
+	}
+
+	if format == "rss" {
+		feed := NewRSS()
+		feed.Channel = channel
+		self := requestBase(r) + page.Feed
+		html := requestBase(r) + searchRoute + "?" + filter.values().Encode()
+		feed.Channel.AtomLink = NewAtomLink(self)
+		feed.Channel.HubLink = nil
+		feed.Channel.PodcastGUID = ""
+		if link, err := parseURL(html); err == nil {
+			feed.Channel.Link, feed.Channel.Image.Link = link, link
+		}
+		feed.Channel.Title = fmt.Sprintf("%s (%s)", channel.Title, filter.describe())
+		feed.Channel.Image.Title = feed.Channel.Title
+		feed.Channel.Items = nil
+		for _, result := range results {
+			feed.Channel.Items = append(feed.Channel.Items, result.Item)
+		}
+		sort.SliceStable(feed.Channel.Items, func(i, j int) bool {
+			return time.Time(feed.Channel.Items[i].PublishDate).After(time.Time(feed.Channel.Items[j].PublishDate))
+		})
+		writeRSS(w, r, feed, nil)
+		return
+	}
+
+	for _, result := range results {
+		page.Results = append(page.Results, searchHit{
+			Podcast:     result.Podcast.Name,
+			Prefix:      result.Podcast.Path,
+			Title:       result.Item.Title,
+			Description: result.Item.Description,
+			GUID:        result.Item.GUID.Value,
+			Enclosure:   result.Item.Enclosure.URL.String(),
+			Published:   time.Time(result.Item.PublishDate),
+			Score:       math.Round(result.Score*1000) / 1000,
+		})
+	}
+	if format == "json" {
+		buf, err := json.MarshalIndent(page, "", "  ")
+		if err != nil {
+			http.Error(w, "Failed to encode search results", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(append(buf, '\n'))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := searchTemplate.Execute(w, page); err != nil {
+		loggerFrom(r.Context()).Error("Failed to render search", "err", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text   string
+		tokens []string
+	}{
+		{"Investigation on Mariappan`s Murder case", []string{"investigation", "mariappan", "murder", "case"}},
+		{"Crime-Diary EP 33", []string{"crime", "diary", "ep", "33"}},
+		// the nukta of क़ is dropped and की is a stop word
+		{"क़त्ल की कहानी।", []string{"कत्ल", "कहानी"}},
+		{"क़त्ल", []string{"कत्ल"}},
+		{"हँसी", []string{"हंसी"}},
+		{"एपिसोड ३८", []string{"एपिसोड", "38"}},
+		// the vowel signs and pulli are kept, ஒரு is a stop word
+		{"கொலையில் ஒரு மர்மம், அத்தியாயம் ௧௨", []string{"கொலையில்", "மர்மம்", "அத்தியாயம்", "12"}},
+		{"क्‍ष", []string{"क्ष"}},
+	}
+	for _, test := range tests {
+		if tokens := tokenize(test.text); !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("Expected %q to be %q but was %q", test.text, test.tokens, tokens)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	docs := []searchDoc{
+		{Item: Item{Title: "Murder of a singer", Description: "An investigation"}},
+		{Item: Item{Title: "Bank robbery", Description: "Murder investigation of a bank employee"}},
+		{Item: Item{Title: "கொலையில் மர்மம்", Description: "கொலை வழக்கு"}},
+		{Item: Item{Title: "क़त्ल की कहानी", Description: "पुलिस की जांच"}},
+	}
+	ix := newSearchIndex(docs)
+	titles := func(results []searchResult) []string {
+		var titles []string
+		for _, result := range results {
+			titles = append(titles, result.Item.Title)
+		}
+		return titles
+	}
+	tests := []struct {
+		query  string
+		titles []string
+	}{
+		{"murder", []string{"Murder of a singer", "Bank robbery"}},
+		{"MURDER bank", []string{"Bank robbery"}},
+		{"murders", nil},
+		{"invest", []string{"Murder of a singer", "Bank robbery"}},
+		{"கொலை", []string{"கொலையில் மர்மம்"}},
+		{"कत्ल", []string{"क़त्ल की कहानी"}},
+		{"जांच", []string{"क़त्ल की कहानी"}},
+		{"the", nil},
+		{"ba", nil},
+	}
+	for _, test := range tests {
+		if got := titles(ix.search(test.query)); !reflect.DeepEqual(got, test.titles) {
+			t.Errorf("Expected %q to find %q but found %q", test.query, test.titles, got)
+		}
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	fake := newFakeRadioCity(t)
+	config := Config{Podcasts: podcasts, Master: &MasterFeed{Title: "Crime Podcasts", Language: "tamil"}}
+	mux := newServeMux(config, scrapeFeed, buildFeed)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://feeds.example.com/search?"+query, nil))
+		return w
+	}
+
+	w := get("q=murder+investigation&format=json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the search to succeed but was %d\n%s", w.Code, w.Body.String())
+	}
+	var page searchPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Failed to parse search results\n%q", err)
+	}
+	if len(page.Results) == 0 {
+		t.Fatalf("Expected episodes about murder investigations")
+	}
+	for _, hit := range page.Results {
+		text := strings.ToLower(hit.Title + " " + hit.Description)
+		if !strings.Contains(text, "murder") || !strings.Contains(text, "investigation") || hit.Prefix == "" || hit.Enclosure == "" {
+			t.Errorf("Expected %+v to match both terms and name its podcast", hit)
+		}
+	}
+	if page.Feed != "/search?format=rss&q=murder+investigation" {
+		t.Errorf("Expected the feed of the search but was %s", page.Feed)
+	}
+
+	// the index is kept
+	requests := len(fake.Requests())
+	w = get("q=murder&format=rss&lang=tamil")
+	feed := w.Body.String()
+	if w.Code != http.StatusOK || strings.Count(feed, "<item>") == 0 {
+		t.Fatalf("Expected a feed of the matches but was %d", w.Code)
+	}
+	if strings.Count(feed, "<source ") != strings.Count(feed, `<source url="http://feeds.example.com/cd">`) {
+		t.Errorf("Expected only the tamil podcast to match")
+	}
+	if !strings.Contains(feed, `<atom:link href="http://feeds.example.com/search?format=rss&amp;lang=tamil&amp;q=murder" rel="self" type="application/rss+xml"></atom:link>`) {
+		t.Errorf("Expected the feed to link itself")
+	}
+	if !strings.Contains(feed, "<title>Crime Podcasts (") || !strings.Contains(feed, "<language>ta</language>") {
+		t.Errorf("Expected the feed to be described like the master feed")
+	}
+	if len(fake.Requests()) != requests {
+		t.Errorf("Expected the episodes not to be scraped again")
+	}
+
+	w = get("q=murder&limit=2")
+	if body := w.Body.String(); !strings.Contains(body, `<input type="search" name="q" value="murder"`) || strings.Count(body, "<li>") != 2 {
+		t.Errorf("Expected an html page of 2 results\n%s", body)
+	}
+	if w = get(""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<ol>") {
+		t.Errorf("Expected the search form without a query")
+	}
+	for _, query := range []string{"format=json", "q=murder&format=xml", "q=murder&since=yesterday"} {
+		if w = get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be a bad request but was %d", query, w.Code)
+		}
+	}
+}
+
+func TestSearcherRebuild(t *testing.T) {
+	var calls int
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := newSearcher(nil, func(ctx context.Context, podcasts []Podcast, selfLink AtomLink) (RSS, error) {
+		calls++
+		if calls > 1 {
+			close(entered)
+			<-release
+		}
+		return RSS{Channel: Channel{Title: "master", Items: []Item{{Title: "Murder of a singer"}}}}, nil
+	})
+	ctx := context.Background()
+	stale, _, err := s.current(ctx, "http://feeds.example.com/master")
+	if err != nil {
+		t.Fatalf("Failed to build the index\n%q", err)
+	}
+
+	start := now()
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return start.Add(searchTTL) }
+	done := make(chan *searchIndex)
+	go func() {
+		index, _, _ := s.current(ctx, "http://feeds.example.com/master")
+		done <- index
+	}()
+	<-entered
+	if index, _, err := s.current(ctx, "http://feeds.example.com/master"); err != nil || index != stale {
+		t.Errorf("Expected the stale index to be served during the rebuild")
+	}
+	close(release)
+	rebuilt := <-done
+	if rebuilt == stale {
+		t.Errorf("Expected the index to be rebuilt")
+	}
+	if index, _, _ := s.current(ctx, "http://feeds.example.com/master"); index != rebuilt || calls != 2 {
+		t.Errorf("Expected the rebuilt index to be kept but the episodes were indexed %d times", calls)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>RadioCity Podcast Feeds</title>
+{{- if .OPML}}
+<link rel="alternate" type="text/x-opml" title="All podcasts" href="{{.OPML}}">
+{{- end}}
+</head>
+<body>
+<h1>RadioCity Podcast Feeds</h1>
+<ul>
+{{- range .Links}}
+<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+type feedLink struct {
+	Name string
+	Href string
+}
+
+// indexPage is the data rendered by the index template
+type indexPage struct {
+	Links []feedLink
+	OPML  string
+}
+
+// newIndexPage links every podcast to the feed returned by href
+func newIndexPage(podcasts []Podcast, href func(Podcast) string) indexPage {
+	page := indexPage{}
+	for _, podcast := range podcasts {
+		page.Links = append(page.Links, feedLink{Name: podcast.Name, Href: href(podcast)})
+	}
+	return page
+}
+
+// IndexHandler lists the configured podcasts with links to their feeds
+func IndexHandler(podcasts []Podcast) http.HandlerFunc {
+	page := newIndexPage(podcasts, func(p Podcast) string { return p.Path })
+	page.OPML = "/opml"
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := indexTemplate.Execute(w, page); err != nil {
+			loggerFrom(r.Context()).Error("Failed to render index", "err", err)
+		}
+	}
+}
+
+// RSSScrapeHandler serves the feed for a single podcast built by the
+// builder, narrowed down by the filter in the query
+func RSSScrapeHandler(podcast Podcast, builder FeedBuilder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFeedFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := withLogger(r.Context(), loggerFrom(r.Context()).With("podcast", podcast.Path))
+		rss, err := builder(ctx, podcast, NewAtomLink(filter.link(requestBase(r)+r.URL.Path)))
+		if !filter.matchesPodcast(podcast) {
+			rss.Channel.Items = nil
+		}
+		filter.apply(&rss.Channel)
+		writeRSS(w, r.WithContext(ctx), rss, err)
+	}
+}
+
+// MasterHandler serves the combined feed of all the podcasts, narrowed
+// down by the filter in the query. Podcasts in other languages than the
+// one filtered on are not scraped.
+func MasterHandler(podcasts []Podcast, builder MasterFeedBuilder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseFeedFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rss, err := builder(r.Context(), filter.podcasts(podcasts), NewAtomLink(filter.link(requestBase(r)+r.URL.Path)))
+		filter.apply(&rss.Channel)
+		writeRSS(w, r, rss, err)
+	}
+}
+
+func writeRSS(w http.ResponseWriter, r *http.Request, rss RSS, err error) {
+	logger := loggerFrom(r.Context())
+	if err != nil {
+		logger.Error("Failed to build feed", "err", err)
+		http.Error(w, "Failed to build feed", http.StatusBadGateway)
+		return
+	}
+	out, err := writeFeed(rss)
+	if err != nil {
+		logger.Error("Failed to write feed", "err", err)
+		http.Error(w, "Failed to write feed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+// requestBase is the scheme and host the client used for the request
+func requestBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withRequestLogging tags every request with an id, attaches a request
+// scoped logger to the context and logs the outcome of the request
+func withRequestLogging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		logger := rootLogger.With("request_id", id, "path", r.URL.Path)
+		ctx := context.WithValue(withLogger(r.Context(), logger), requestIDKey, id)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		logger.Info("Handled request", "component", "http", "method", r.Method, "status", rec.status, "duration", time.Since(start))
+	})
+}
+
+// newServeMux routes the index, the master feed, the composite feeds, the
+// validator and every podcast feed, along with the mirrored media and the
+// resized artwork when the config has directories for them and the WebSub
+// hub when it is enabled
+func newServeMux(config Config, builder FeedBuilder, master MasterFeedBuilder) *http.ServeMux {
+	podcasts := config.Podcasts
+	mux := http.NewServeMux()
+	if config.ArtworkDir != "" {
+		p := newArtworkProxy(config)
+		builder, master = p.feedBuilder(builder), p.masterBuilder(master)
+		mux.Handle(artworkRoute, p)
+	}
+	if config.MediaDir != "" {
+		m := newMediaMirror(config.MediaDir)
+		builder, master = m.feedBuilder(builder), m.masterBuilder(master)
+		mux.Handle(mediaRoute, m)
+	}
+	feedHandler := func(h http.Handler) http.Handler { return h }
+	if config.WebSub {
+		feeds := map[string]bool{"/master": true}
+		for _, podcast := range podcasts {
+			feeds[podcast.Path] = true
+		}
+		for _, feed := range config.Feeds {
+			feeds[feed.Path] = true
+		}
+		hub := newWebsubHub(func(path string) bool { return feeds[path] })
+		hub.fetch = serverFetch(mux)
+		builder, master = hub.feedBuilder(builder), hub.masterBuilder(master)
+		feedHandler = hub.observing
+		mux.Handle(hubRoute, hub)
+	}
+	for _, podcast := range podcasts {
+		mux.Handle(podcast.Path, feedHandler(RSSScrapeHandler(podcast, builder)))
+	}
+	for _, feed := range config.Feeds {
+		mux.Handle(feed.Path, feedHandler(MasterHandler(podcasts, compositeBuilder(feed, master))))
+	}
+	configured := masterBuilder(config.master(), master)
+	mux.Handle("/master", feedHandler(MasterHandler(podcasts, configured)))
+	mux.Handle(searchRoute, newSearcher(podcasts, configured))
+	mux.Handle("/opml", OPMLHandler(podcasts))
+	mux.Handle("/validate", ValidateHandler(config, builder, master))
+	index := IndexHandler(podcasts)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		index(w, r)
+	})
+	return mux
+}
+
+// runServe implements the serve command
+func runServe(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to serve the feeds on")
+	checkEvery := fs.Duration("check-links", 0, "check the enclosures and images of every podcast at this interval and report them at /status, eg. 6h")
+	notifyEvery := fs.Duration("notify", 15*time.Minute, "check for new episodes to post to the webhooks at this interval")
+	fs.Parse(args)
+	if problems := validateConfig(config); len(problems) > 0 {
+		return fmt.Errorf("Invalid config: %s", strings.Join(problems, "; "))
+	}
+	rootLogger.Info("Serving feeds", "addr", *addr, "podcasts", len(config.Podcasts))
+	builder, master := FeedBuilder(scrapeFeed), MasterFeedBuilder(buildFeed)
+	if c := artworkFrom(ctx); c != nil {
+		// requests do not derive from ctx so the cache is passed on by the builders
+		builder, master = c.feedBuilder(builder), c.masterBuilder(master)
+	}
+	var refresher *scheduler
+	if config.Refresh != nil {
+		var err error
+		if refresher, err = newScheduler(config); err != nil {
+			return err
+		}
+		builder, master = refresher.feedBuilder(builder), refresher.masterBuilder(master)
+		// the webhooks are notified of the episodes refreshed
+		ctx = withScheduler(ctx, refresher)
+		go refresher.run(ctx)
+	}
+	mux := newServeMux(config, builder, master)
+	if refresher != nil {
+		mux.Handle(scheduleRoute, refresher)
+	}
+	if *checkEvery > 0 {
+		checker := newLinkChecker(config.Podcasts, *checkEvery)
+		go checker.run(ctx)
+		mux.Handle("/status", checker)
+	}
+	if len(config.Webhooks) > 0 && *notifyEvery > 0 {
+		n, err := newNotifier(config)
+		if err != nil {
+			return err
+		}
+		go n.run(ctx, *notifyEvery)
+	}
+	return http.ListenAndServe(*addr, withRequestLogging(mux))
+}
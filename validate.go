@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// reservedPaths are served by the server itself and cannot be prefixes
+var reservedPaths = map[string]bool{"/": true, "/master": true, "/opml": true, "/validate": true, "/media": true, "/status": true, "/artwork": true, "/hub": true, "/schedule": true, "/search": true}
+
+// validateConfig reports the problems which would keep podcasts from
+// being served
+func validateConfig(config Config) []string {
+	var problems []string
+	if len(config.Podcasts) == 0 {
+		problems = append(problems, "no podcasts configured")
+	}
+	if config.BaseURL != "" {
+		if u, err := url.Parse(config.BaseURL); err != nil || !u.IsAbs() {
+			problems = append(problems, fmt.Sprintf("baseUrl %q is not an absolute url", config.BaseURL))
+		}
+	}
+	if config.ArtworkSize != 0 && (config.ArtworkSize < minArtwork || config.ArtworkSize > maxArtwork) {
+		problems = append(problems, fmt.Sprintf("artworkSize %d is not between %d and %d", config.ArtworkSize, minArtwork, maxArtwork))
+	}
+	seen := make(map[string]bool)
+	for i, podcast := range config.Podcasts {
+		name := podcast.Path
+		if name == "" {
+			name = fmt.Sprintf("podcast %d", i+1)
+		}
+		switch {
+		case !strings.HasPrefix(podcast.Path, "/"):
+			problems = append(problems, fmt.Sprintf("%s: prefix must start with /", name))
+		case reservedPaths[podcast.Path]:
+			problems = append(problems, fmt.Sprintf("%s: prefix is reserved", name))
+		case seen[podcast.Path]:
+			problems = append(problems, fmt.Sprintf("%s: prefix is used by more than one podcast", name))
+		}
+		seen[podcast.Path] = true
+		if strings.TrimSpace(podcast.Name) == "" {
+			problems = append(problems, fmt.Sprintf("%s: name is empty", name))
+		}
+		if u, err := url.Parse(podcast.URL); err != nil || !u.IsAbs() {
+			problems = append(problems, fmt.Sprintf("%s: url %q is not an absolute url", name, podcast.URL))
+		}
+		if podcast.Image != "" {
+			if u, err := url.Parse(podcast.Image); err != nil || !u.IsAbs() {
+				problems = append(problems, fmt.Sprintf("%s: imageUrl %q is not an absolute url", name, podcast.Image))
+			}
+		}
+		if len(podcast.Categories) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: no categories", name))
+		}
+		problems = append(problems, validateEpisodes(name, podcast)...)
+	}
+	problems = append(problems, validateWebhooks(config)...)
+	problems = append(problems, validateDigest(config)...)
+	problems = append(problems, validateRefresh(config)...)
+	return append(problems, validateComposites(config)...)
+}
+
+// Levels of the problems found in feeds, errors keep a feed from being
+// accepted by the podcast directories
+const (
+	levelError   = "error"
+	levelWarning = "warning"
+)
+
+// feedProblem is a problem found in a feed, Item is empty for problems
+// with the channel
+type feedProblem struct {
+	Level   string `json:"level"`
+	Item    string `json:"item,omitempty"`
+	GUID    string `json:"guid,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p feedProblem) String() string {
+	where := "channel"
+	if p.Item != "" {
+		where = p.Item
+		if p.GUID != "" {
+			where += " " + p.GUID
+		}
+	}
+	return fmt.Sprintf("%-7s %s: %s", p.Level, where, p.Message)
+}
+
+// feedReport lists the problems found in a feed
+type feedReport struct {
+	Feed     string        `json:"feed"`
+	Items    int           `json:"items"`
+	Errors   int           `json:"errors"`
+	Warnings int           `json:"warnings"`
+	Problems []feedProblem `json:"problems"`
+}
+
+func (r *feedReport) add(level string, item int, guid string, format string, args ...interface{}) {
+	problem := feedProblem{Level: level, Message: fmt.Sprintf(format, args...)}
+	if item > 0 {
+		problem.Item = fmt.Sprintf("item %d", item)
+		problem.GUID = guid
+	}
+	if level == levelError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+	r.Problems = append(r.Problems, problem)
+}
+
+// supportedMediaTypes are the enclosure types accepted by both Apple
+// Podcasts and Spotify
+var supportedMediaTypes = map[string]bool{
+	"audio/mpeg":      true,
+	"audio/mp4":       true,
+	"audio/x-m4a":     true,
+	"audio/aac":       true,
+	"video/mp4":       true,
+	"video/quicktime": true,
+	"video/x-m4v":     true,
+}
+
+// languageTag matches the ISO 639 language codes allowed in rss feeds
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// maxDescription is the longest description Apple Podcasts accepts
+const maxDescription = 4000
+
+// checkFeedURL reports links which are missing, relative or not served
+// over http
+func checkFeedURL(u URL, what string) (string, string) {
+	switch {
+	case u.String() == "":
+		return levelError, what + " is missing"
+	case u.Scheme == "" || u.Host == "":
+		return levelError, fmt.Sprintf("%s %q is not an absolute url", what, u.String())
+	case u.Scheme != "http" && u.Scheme != "https":
+		return levelError, fmt.Sprintf("%s %q is not an http url", what, u.String())
+	case u.Scheme == "http":
+		return levelWarning, fmt.Sprintf("%s %q is not served over https", what, u.String())
+	}
+	return "", ""
+}
+
+// checkDate reports dates which cannot be written as RFC 822 dates
+func checkDate(d XMLDate, what string) (string, string) {
+	t := time.Time(d)
+	switch {
+	case t.IsZero():
+		return levelError, what + " is missing"
+	case t.Year() < 1900 || t.Year() > 9999:
+		return levelError, fmt.Sprintf("%s year %d cannot be written as an RFC 822 date", what, t.Year())
+	case t.After(now().Add(24 * time.Hour)):
+		return levelWarning, fmt.Sprintf("%s %s is in the future", what, t.Format(time.RFC1123Z))
+	}
+	return "", ""
+}
+
+// checkImageURL reports artwork links which are not usable by the podcast
+// directories, the image itself is checked by checkArtwork
+func checkImageURL(u URL, what string) (string, string) {
+	if level, msg := checkFeedURL(u, what); level != "" {
+		return level, msg
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".jpg", ".jpeg", ".png":
+		return "", ""
+	}
+	return levelWarning, fmt.Sprintf("%s %q does not look like a jpeg or png image", what, u.String())
+}
+
+// checkFeed checks the feed against the RSS 2.0 specification and the
+// requirements of Apple Podcasts and Spotify
+func checkFeed(name string, rss RSS) feedReport {
+	report := feedReport{Feed: name, Items: len(rss.Channel.Items), Problems: []feedProblem{}}
+	channelProblem := func(level, msg string) {
+		if level != "" {
+			report.add(level, 0, "", "%s", msg)
+		}
+	}
+	if rss.Version != "2.0" {
+		report.add(levelError, 0, "", "rss version is %q instead of 2.0", rss.Version)
+	}
+	channel := rss.Channel
+	if strings.TrimSpace(channel.Title) == "" {
+		report.add(levelError, 0, "", "title is missing")
+	}
+	if strings.TrimSpace(channel.Description) == "" {
+		report.add(levelError, 0, "", "description is missing")
+	} else if length := utf8.RuneCountInString(channel.Description); length > maxDescription {
+		report.add(levelWarning, 0, "", "description is %d characters, Apple Podcasts shows at most %d", length, maxDescription)
+	}
+	channelProblem(checkFeedURL(channel.Link, "link"))
+	if channel.AtomLink.Rel != "self" || channel.AtomLink.URL.String() == "" {
+		report.add(levelWarning, 0, "", "atom:link to the feed itself is missing")
+	} else {
+		channelProblem(checkFeedURL(channel.AtomLink.URL, "atom:link"))
+	}
+	switch {
+	case channel.Language == "":
+		report.add(levelError, 0, "", "language is missing")
+	case !languageTag.MatchString(channel.Language):
+		report.add(levelError, 0, "", "language %q is not an ISO 639 code", channel.Language)
+	}
+	if channel.PublishDate != (XMLDate{}) {
+		channelProblem(checkDate(channel.PublishDate, "pubDate"))
+	}
+	if channel.LastBuildDate != (XMLDate{}) {
+		channelProblem(checkDate(channel.LastBuildDate, "lastBuildDate"))
+	}
+	if channel.Image.URL.String() != "" {
+		channelProblem(checkImageURL(channel.Image.URL, "image url"))
+	}
+	channelProblem(checkImageURL(channel.ItunesImage.URL, "itunes:image"))
+	if len(channel.ItunesCategories) == 0 {
+		report.add(levelError, 0, "", "itunes:category is missing")
+	}
+	switch channel.ItunesExplicit {
+	case "true", "false":
+	case "":
+		report.add(levelError, 0, "", "itunes:explicit is missing")
+	default:
+		report.add(levelError, 0, "", "itunes:explicit is %q instead of true or false", channel.ItunesExplicit)
+	}
+	if len(channel.Items) == 0 {
+		report.add(levelWarning, 0, "", "feed has no items")
+	}
+
+	guids := make(map[string]int)
+	enclosures := make(map[string]int)
+	for i, item := range channel.Items {
+		n, guid := i+1, item.GUID.Value
+		problem := func(level, msg string) {
+			if level != "" {
+				report.add(level, n, guid, "%s", msg)
+			}
+		}
+		if strings.TrimSpace(item.Title) == "" {
+			report.add(levelError, n, guid, "title is missing")
+		}
+		if length := utf8.RuneCountInString(item.Description); length > maxDescription {
+			report.add(levelWarning, n, guid, "description is %d characters, Apple Podcasts shows at most %d", length, maxDescription)
+		}
+		switch first, seen := guids[guid]; {
+		case strings.TrimSpace(guid) == "":
+			report.add(levelError, n, guid, "guid is missing")
+		case seen:
+			report.add(levelError, n, guid, "guid is the same as item %d", first)
+		default:
+			guids[guid] = n
+		}
+		if item.GUID.PermaLink {
+			if u, err := url.Parse(guid); err != nil || !u.IsAbs() {
+				report.add(levelError, n, guid, "guid is a permalink but not an absolute url")
+			}
+		}
+		problem(checkDate(item.PublishDate, "pubDate"))
+		if item.Link.String() != "" {
+			problem(checkFeedURL(item.Link, "link"))
+		}
+
+		enclosure := item.Enclosure
+		problem(checkFeedURL(enclosure.URL, "enclosure url"))
+		if u := enclosure.URL.String(); u != "" {
+			if first, seen := enclosures[u]; seen {
+				report.add(levelWarning, n, guid, "enclosure url is the same as item %d", first)
+			} else {
+				enclosures[u] = n
+			}
+		}
+		if enclosure.Length <= 0 {
+			report.add(levelError, n, guid, "enclosure length is %d", enclosure.Length)
+		}
+		if enclosure.Type == "" {
+			report.add(levelError, n, guid, "enclosure type is missing")
+		} else if mediaType, _, err := mime.ParseMediaType(enclosure.Type); err != nil {
+			report.add(levelError, n, guid, "enclosure type %q is not a mime type", enclosure.Type)
+		} else if !supportedMediaTypes[mediaType] {
+			report.add(levelWarning, n, guid, "enclosure type %s is not supported by Apple Podcasts and Spotify", mediaType)
+		}
+		if item.ItunesImage.URL.String() != "" {
+			problem(checkImageURL(item.ItunesImage.URL, "itunes:image"))
+		}
+	}
+	return report
+}
+
+// Apple Podcasts artwork must be a square between these sizes in pixels
+const (
+	minArtwork = 1400
+	maxArtwork = 3000
+)
+
+// artworkProblems checks the decoded header of an artwork image
+func artworkProblems(cfg image.Config, format string) []string {
+	var problems []string
+	if format != "jpeg" && format != "png" {
+		problems = append(problems, fmt.Sprintf("is a %s image instead of jpeg or png", format))
+	}
+	if cfg.Width != cfg.Height {
+		problems = append(problems, fmt.Sprintf("is %dx%d instead of square", cfg.Width, cfg.Height))
+	}
+	if cfg.Width < minArtwork || cfg.Width > maxArtwork || cfg.Height < minArtwork || cfg.Height > maxArtwork {
+		problems = append(problems, fmt.Sprintf("is %dx%d, artwork must be between %dx%d and %dx%d", cfg.Width, cfg.Height, minArtwork, minArtwork, maxArtwork, maxArtwork))
+	}
+	return problems
+}
+
+// loadImageConfig decodes the size and format of the image at the url,
+// through the artwork cache of the context when it has one
+func loadImageConfig(ctx context.Context, link string) (image.Config, string, error) {
+	if c := artworkFrom(ctx); c != nil {
+		return c.imageConfig(ctx, link)
+	}
+	return fetchImageConfig(ctx, link)
+}
+
+// fetchImageConfig loads the image at the url and decodes its size and
+// format
+func fetchImageConfig(ctx context.Context, link string) (image.Config, string, error) {
+	buf, err := loadUrl(ctx, link)
+	if err != nil {
+		return image.Config{}, "", errors.Wrapf(err, "%s cannot be loaded", link)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return cfg, format, errors.Wrapf(err, "%s is not an image", link)
+	}
+	return cfg, format, nil
+}
+
+// validateImages loads the images configured for the master and composite
+// feeds and reports those which are not images
+func validateImages(ctx context.Context, config Config) []string {
+	var problems []string
+	check := func(name, link string) {
+		if _, _, err := loadImageConfig(ctx, link); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: imageUrl %s", name, err))
+		}
+	}
+	img := config.master().Image
+	if img == "" {
+		img = masterImage
+	}
+	check("master", img)
+	for _, feed := range config.Feeds {
+		if feed.Image != "" {
+			check(feed.Path, feed.Image)
+		}
+	}
+	return problems
+}
+
+// checkArtwork loads the channel and episode artwork of the feed and
+// reports images which do not meet the Apple Podcasts artwork rules. Each
+// image is only loaded once.
+func checkArtwork(ctx context.Context, rss RSS, report *feedReport) {
+	checked := make(map[string]bool)
+	check := func(u URL, item int, guid string) {
+		link := u.String()
+		if link == "" || checked[link] {
+			return
+		}
+		checked[link] = true
+		cfg, format, err := loadImageConfig(ctx, link)
+		if err != nil {
+			report.add(levelError, item, guid, "artwork %s", err)
+			return
+		}
+		for _, problem := range artworkProblems(cfg, format) {
+			report.add(levelError, item, guid, "artwork %s %s", link, problem)
+		}
+	}
+	check(rss.Channel.ItunesImage.URL, 0, "")
+	for i, item := range rss.Channel.Items {
+		check(item.ItunesImage.URL, i+1, item.GUID.Value)
+	}
+}
+
+// validateFeeds builds and checks the feeds with the prefixes, every
+// podcast, composite and the master feed when no prefixes are given
+func validateFeeds(ctx context.Context, config Config, prefixes []string, images bool) ([]feedReport, error) {
+	if len(prefixes) == 0 {
+		for _, podcast := range config.Podcasts {
+			prefixes = append(prefixes, podcast.Path)
+		}
+		for _, feed := range config.Feeds {
+			prefixes = append(prefixes, feed.Path)
+		}
+		prefixes = append(prefixes, "/master")
+	}
+	var reports []feedReport
+	for _, prefix := range prefixes {
+		build, prefix, err := findFeed(config, prefix)
+		if err != nil {
+			return reports, err
+		}
+		rss, err := build(ctx, NewAtomLink(config.absoluteURL(prefix)))
+		if err != nil {
+			return reports, errors.Wrapf(err, "Failed to build %s", prefix)
+		}
+		report := checkFeed(prefix, rss)
+		if images {
+			checkArtwork(ctx, rss, &report)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// ValidateHandler builds the feed at the path given in the query and
+// responds with the problems found in it as json. The artwork is loaded
+// and checked as well with images=true.
+func ValidateHandler(config Config, builder FeedBuilder, master MasterFeedBuilder) http.HandlerFunc {
+	podcasts := config.Podcasts
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, logger := r.Context(), loggerFrom(r.Context())
+		feedPath := r.URL.Query().Get("path")
+		if feedPath == "" {
+			http.Error(w, "Missing the path of the feed to validate", http.StatusBadRequest)
+			return
+		}
+		images, _ := strconv.ParseBool(r.URL.Query().Get("images"))
+		selfLink := NewAtomLink(requestBase(r) + feedPath)
+		var rss RSS
+		var err error
+		if feed, ok := findComposite(config.Feeds, feedPath); ok {
+			rss, err = compositeBuilder(feed, master)(ctx, podcasts, selfLink)
+		} else if feedPath == "/master" {
+			rss, err = masterBuilder(config.master(), master)(ctx, podcasts, selfLink)
+		} else {
+			found := false
+			for _, podcast := range podcasts {
+				if podcast.Path == feedPath {
+					found = true
+					rss, err = builder(withLogger(ctx, logger.With("podcast", podcast.Path)), podcast, selfLink)
+					break
+				}
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("No feed is served at %s", feedPath), http.StatusNotFound)
+				return
+			}
+		}
+		if err != nil {
+			logger.Error("Failed to build feed", "feed", feedPath, "err", err)
+			http.Error(w, "Failed to build feed", http.StatusBadGateway)
+			return
+		}
+		report := checkFeed(feedPath, rss)
+		if images {
+			checkArtwork(ctx, rss, &report)
+		}
+		buf, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			logger.Error("Failed to encode validation report", "err", err)
+			http.Error(w, "Failed to encode validation report", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(append(buf, '\n'))
+	}
+}
+
+// runValidate implements the validate command
+func runValidate(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configOnly := fs.Bool("config-only", false, "only check the config, without building the feeds")
+	images := fs.Bool("images", false, "load the artwork and check the image dimensions")
+	fs.Parse(args)
+	problems := validateConfig(config)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problems in the config", len(problems))
+	}
+	if *configOnly {
+		return nil
+	}
+	if problems := validateImages(ctx, config); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		return fmt.Errorf("Found %d images in the config which cannot be loaded", len(problems))
+	}
+	reports, err := validateFeeds(ctx, config, fs.Args(), *images)
+	errorCount := 0
+	for _, report := range reports {
+		fmt.Printf("%s: %d items, %d errors, %d warnings\n", report.Feed, report.Items, report.Errors, report.Warnings)
+		for _, problem := range report.Problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		errorCount += report.Errors
+	}
+	if err != nil {
+		return err
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("Found %d errors in %d feeds", errorCount, len(reports))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// hasProblem reports whether the report has a problem of the level for the
+// item containing the text
+func hasProblem(report feedReport, level, item, text string) bool {
+	for _, problem := range report.Problems {
+		if problem.Level == level && problem.Item == item && strings.Contains(problem.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckFeed(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	freezeClock(t)
+	podcast := podcasts[0]
+	rss, err := scrapeFeed(context.Background(), podcast, NewAtomLink("https://feeds.example.com"+podcast.Path))
+	if err != nil {
+		t.Fatalf("Failed to scrape %s\n%q", podcast.Name, err)
+	}
+	report := checkFeed(podcast.Path, rss)
+	if report.Errors != 0 {
+		t.Errorf("Expected the scraped feed to have no errors but found %v", report.Problems)
+	}
+
+	rss.Channel.Language = ""
+	rss.Channel.ItunesExplicit = "no"
+	items := rss.Channel.Items
+	items[1].GUID = items[0].GUID
+	items[2].Enclosure.URL, _ = parseURL("/media/episode.mp3")
+	items[3].Enclosure.Length = 0
+	items[3].Enclosure.Type = "audio/"
+	items[4].Enclosure.Type = "audio/ogg"
+	items[4].PublishDate = XMLDate{}
+	report = checkFeed(podcast.Path, rss)
+	for _, want := range []struct{ level, item, text string }{
+		{levelError, "", "language is missing"},
+		{levelError, "", "itunes:explicit"},
+		{levelError, "item 2", "guid is the same as item 1"},
+		{levelError, "item 3", "not an absolute url"},
+		{levelError, "item 4", "enclosure length is 0"},
+		{levelError, "item 4", "not a mime type"},
+		{levelWarning, "item 5", "audio/ogg is not supported"},
+		{levelError, "item 5", "pubDate is missing"},
+	} {
+		if !hasProblem(report, want.level, want.item, want.text) {
+			t.Errorf("Expected %s %q for %q in %v", want.level, want.text, want.item, report.Problems)
+		}
+	}
+	if report.Errors != 7 {
+		t.Errorf("Expected 7 errors but found %d in %v", report.Errors, report.Problems)
+	}
+}
+
+func TestArtworkProblems(t *testing.T) {
+	if problems := artworkProblems(image.Config{Width: 1400, Height: 1400}, "jpeg"); len(problems) != 0 {
+		t.Errorf("Expected 1400x1400 jpeg artwork to be valid but found %v", problems)
+	}
+	if problems := artworkProblems(image.Config{Width: 600, Height: 400}, "gif"); len(problems) != 3 {
+		t.Errorf("Expected small, oblong gif artwork to have 3 problems but found %v", problems)
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	mux := newServeMux(Config{Podcasts: podcasts}, scrapeFeed, buildFeed)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/validate?path=/kck", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but was %d", w.Code)
+	}
+	var report feedReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to parse validation report\n%q", err)
+	}
+	if report.Feed != "/kck" || report.Items == 0 {
+		t.Errorf("Expected a report of the /kck items but was %+v", report)
+	}
+	if !hasProblem(report, levelWarning, "", "atom:link") {
+		t.Errorf("Expected a warning for the plain http self link in %v", report.Problems)
+	}
+
+	for path, status := range map[string]int{"": http.StatusBadRequest, "/nope": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/validate?path="+path, nil))
+		if w.Code != status {
+			t.Errorf("Expected status %d for %q but was %d", status, path, w.Code)
+		}
+	}
+}
+
+func TestValidateImages(t *testing.T) {
+	fake := newFakeRadioCity(t)
+	config := Config{
+		Master: &MasterFeed{Image: "https://www.radiocity.in/images/master.png"},
+		Feeds: []CompositeFeed{
+			{Path: "/hindi-crime", Image: "https://www.radiocity.in/hindi-crime"},
+			{Path: "/tamil-crime", Image: "https://www.radiocity.in/images/tamil-crime.jpg"},
+		},
+	}
+	problems := validateImages(context.Background(), config)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "/hindi-crime: imageUrl") {
+		t.Errorf("Expected only the /hindi-crime image to fail but found %v", problems)
+	}
+
+	fake.set(func(f *fakeRadioCity) { f.ArtworkSize = 600 })
+	rss := NewRSS()
+	rss.Channel.ItunesImage.URL, _ = parseURL(config.Master.Image)
+	report := feedReport{}
+	checkArtwork(context.Background(), rss, &report)
+	if !hasProblem(report, levelError, "", "is 600x600, artwork must be between") {
+		t.Errorf("Expected small artwork to be an error but found %v", report.Problems)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Webhook is a url told about the new episodes of the podcasts as json
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret signs the payload, see the X-Radio-City-Signature header
+	Secret string `json:"secret,omitempty"`
+	// Podcasts are the prefixes of the podcasts notified about, all of
+	// them when empty
+	Podcasts []string `json:"podcasts,omitempty"`
+}
+
+// wants reports whether the webhook is notified about the podcast
+func (w Webhook) wants(podcast Podcast) bool {
+	return subscribed(w.Podcasts, podcast)
+}
+
+// subscribed reports whether the podcast is among the prefixes, every
+// podcast is when there are none
+func subscribed(prefixes []string, podcast Podcast) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if prefix == podcast.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// episodeEvent is the payload posted to the webhooks, text makes it a
+// message for Slack style incoming webhooks
+type episodeEvent struct {
+	Event     string    `json:"event"`
+	Podcast   string    `json:"podcast"`
+	Prefix    string    `json:"prefix"`
+	Title     string    `json:"title"`
+	GUID      string    `json:"guid"`
+	Enclosure string    `json:"enclosureUrl"`
+	Published time.Time `json:"published"`
+	Text      string    `json:"text"`
+}
+
+func newEpisodeEvent(podcast Podcast, item Item) episodeEvent {
+	return episodeEvent{
+		Event:     "episode.published",
+		Podcast:   podcast.Name,
+		Prefix:    podcast.Path,
+		Title:     item.Title,
+		GUID:      item.GUID.Value,
+		Enclosure: item.Enclosure.URL.String(),
+		Published: time.Time(item.PublishDate),
+		Text:      fmt.Sprintf("New episode of %s: %s %s", podcast.Name, item.Title, item.Enclosure.URL.String()),
+	}
+}
+
+const (
+	// webhookAttempts is how often a delivery is tried before waiting for
+	// the next check
+	webhookAttempts = 4
+	// webhookRetention is how long failed deliveries are retried at the
+	// following checks
+	webhookRetention = 24 * time.Hour
+	// maxDeliveries caps the deliveries kept in the log
+	maxDeliveries = 1000
+)
+
+// webhookBackoff is the wait before the first retry, doubled each retry
+var webhookBackoff = 2 * time.Second
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// webhookDelivery is the outcome of notifying a webhook of an episode
+type webhookDelivery struct {
+	Webhook   string       `json:"webhook"`
+	Event     episodeEvent `json:"event"`
+	Attempts  int          `json:"attempts"`
+	Status    int          `json:"status,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Delivered bool         `json:"delivered"`
+	// FirstAt is the first attempt, failed deliveries are retried until
+	// webhookRetention after it
+	FirstAt time.Time `json:"firstAt"`
+	At      time.Time `json:"at"`
+}
+
+// webhookLog is the delivery log, it keeps the guids of the last scrape of
+// each podcast and the deliveries so that restarts do not notify again
+type webhookLog struct {
+	file string
+
+	mu         sync.Mutex
+	Seen       map[string][]string `json:"seen"`
+	Deliveries []webhookDelivery   `json:"deliveries"`
+}
+
+// loadWebhookLog reads the log from the file, an empty file name keeps the
+// log in memory only
+func loadWebhookLog(file string) (*webhookLog, error) {
+	l := &webhookLog{file: file, Seen: make(map[string][]string)}
+	if file == "" {
+		return l, nil
+	}
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, errors.Wrapf(err, "Failed to read webhook log %s", file)
+	}
+	if err := json.Unmarshal(buf, l); err != nil {
+		return l, errors.Wrapf(err, "Failed to parse webhook log %s", file)
+	}
+	if l.Seen == nil {
+		l.Seen = make(map[string][]string)
+	}
+	return l, nil
+}
+
+// save writes the log atomically
+func (l *webhookLog) save() error {
+	if l.file == "" {
+		return nil
+	}
+	l.mu.Lock()
+	buf, err := json.MarshalIndent(l, "", "  ")
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.file), 0755); err != nil {
+		return errors.Wrap(err, "Failed to create webhook log directory")
+	}
+	_, err = writeIfChanged(l.file, buf)
+	return err
+}
+
+// delivery returns the delivery of the episode to the webhook
+func (l *webhookLog) delivery(webhook, guid string) (webhookDelivery, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range l.Deliveries {
+		if d.Webhook == webhook && d.Event.GUID == guid {
+			return d, true
+		}
+	}
+	return webhookDelivery{}, false
+}
+
+// record replaces the delivery of the episode to the webhook, the oldest
+// deliveries are dropped beyond maxDeliveries
+func (l *webhookLog) record(d webhookDelivery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.Deliveries {
+		if l.Deliveries[i].Webhook == d.Webhook && l.Deliveries[i].Event.GUID == d.Event.GUID {
+			l.Deliveries = append(l.Deliveries[:i], l.Deliveries[i+1:]...)
+			break
+		}
+	}
+	l.Deliveries = append(l.Deliveries, d)
+	if len(l.Deliveries) > maxDeliveries {
+		l.Deliveries = l.Deliveries[len(l.Deliveries)-maxDeliveries:]
+	}
+}
+
+// retries lists the failed deliveries first attempted less than
+// webhookRetention ago
+func (l *webhookLog) retries() []webhookDelivery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var retries []webhookDelivery
+	for _, d := range l.Deliveries {
+		if !d.Delivered && now().Sub(d.FirstAt) < webhookRetention {
+			retries = append(retries, d)
+		}
+	}
+	return retries
+}
+
+// notifier posts the new episodes of the podcasts to the webhooks
+type notifier struct {
+	podcasts []Podcast
+	webhooks []Webhook
+	log      *webhookLog
+}
+
+func newNotifier(config Config) (*notifier, error) {
+	log, err := loadWebhookLog(config.WebhookLog)
+	if err != nil {
+		return nil, err
+	}
+	return &notifier{podcasts: config.Podcasts, webhooks: config.Webhooks, log: log}, nil
+}
+
+// check scrapes the podcasts with webhooks and notifies the webhooks of
+// the episodes whose guids were not in the previous scrape. The first
+// scrape of a podcast only records its episodes. Failed deliveries are
+// retried first.
+func (n *notifier) check(ctx context.Context) (delivered, failed int) {
+	logger := loggerFrom(ctx).With("component", "webhook")
+	secrets := make(map[string]string)
+	for _, webhook := range n.webhooks {
+		secrets[webhook.URL] = webhook.Secret
+	}
+	deliver := func(d webhookDelivery) {
+		d = n.deliver(ctx, d, secrets[d.Webhook])
+		n.log.record(d)
+		if d.Delivered {
+			delivered++
+		} else {
+			failed++
+			logger.Warn("Failed to notify webhook", "webhook", d.Webhook, "guid", d.Event.GUID, "attempts", d.Attempts, "err", d.Error)
+		}
+	}
+	for _, d := range n.log.retries() {
+		if _, ok := secrets[d.Webhook]; ok {
+			deliver(d)
+		}
+	}
+	for _, podcast := range n.podcasts {
+		var webhooks []Webhook
+		for _, webhook := range n.webhooks {
+			if webhook.wants(podcast) {
+				webhooks = append(webhooks, webhook)
+			}
+		}
+		if len(webhooks) == 0 {
+			continue
+		}
+		items, err := scrapeItems(ctx, podcast)
+		if err != nil {
+			logger.Warn("Failed to scrape podcast", "podcast", podcast.Path, "err", err)
+			continue
+		}
+		n.log.mu.Lock()
+		previous, scraped := n.log.Seen[podcast.Path]
+		n.log.mu.Unlock()
+		fresh, guids := freshItems(items, previous, scraped)
+		for _, item := range fresh {
+			for _, webhook := range webhooks {
+				if _, ok := n.log.delivery(webhook.URL, item.GUID.Value); ok {
+					continue
+				}
+				deliver(webhookDelivery{Webhook: webhook.URL, Event: newEpisodeEvent(podcast, item)})
+			}
+		}
+		n.log.mu.Lock()
+		n.log.Seen[podcast.Path] = guids
+		n.log.mu.Unlock()
+		if err := n.log.save(); err != nil {
+			logger.Warn("Failed to save webhook log", "err", err)
+		}
+	}
+	if err := n.log.save(); err != nil {
+		logger.Warn("Failed to save webhook log", "err", err)
+	}
+	logger.Info("Checked for new episodes", "delivered", delivered, "failed", failed)
+	return delivered, failed
+}
+
+// deliver posts the event to the webhook, retrying network errors, 429
+// and server errors with a doubling backoff
+func (n *notifier) deliver(ctx context.Context, d webhookDelivery, secret string) webhookDelivery {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	wait := webhookBackoff
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				d.Error = ctx.Err().Error()
+				return d
+			}
+			wait *= 2
+		}
+		d.Attempts++
+		d.At = now()
+		if d.FirstAt.IsZero() {
+			d.FirstAt = d.At
+		}
+		retry := true
+		d.Status, err = postWebhook(ctx, d.Webhook, secret, body)
+		switch {
+		case err != nil:
+			d.Error = err.Error()
+		case d.Status/100 == 2:
+			d.Delivered, d.Error = true, ""
+			return d
+		default:
+			d.Error = fmt.Sprintf("webhook responded with status %d", d.Status)
+			retry = d.Status == http.StatusTooManyRequests || d.Status >= 500
+		}
+		if !retry {
+			return d
+		}
+	}
+	return d
+}
+
+// postWebhook posts the payload signed with the secret
+func postWebhook(ctx context.Context, webhook, secret string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "radio-city")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Radio-City-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// freshItems returns the items whose guids are not among the previous
+// ones, oldest first, along with the guids of all the items. Nothing is
+// fresh when the podcast was not scraped before.
+func freshItems(items []Item, previous []string, scraped bool) ([]Item, []string) {
+	seen := make(map[string]bool)
+	for _, guid := range previous {
+		seen[guid] = true
+	}
+	var fresh []Item
+	guids := make([]string, 0, len(items))
+	for _, item := range items {
+		guids = append(guids, item.GUID.Value)
+		if scraped && !seen[item.GUID.Value] {
+			fresh = append(fresh, item)
+		}
+	}
+	sort.SliceStable(fresh, func(i, j int) bool {
+		return time.Time(fresh[i].PublishDate).Before(time.Time(fresh[j].PublishDate))
+	})
+	return fresh, guids
+}
+
+// run checks for new episodes right away and then at every interval until
+// the context is done
+func (n *notifier) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// validateWebhooks reports the webhooks which cannot be notified
+func validateWebhooks(config Config) []string {
+	var problems []string
+	configured := make(map[string]bool)
+	for _, podcast := range config.Podcasts {
+		configured[podcast.Path] = true
+	}
+	for i, webhook := range config.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("webhook %d: url %q is not an http url", i+1, webhook.URL))
+		}
+		for _, prefix := range webhook.Podcasts {
+			if !configured[prefix] {
+				problems = append(problems, fmt.Sprintf("webhook %d: no podcast configured with prefix %s", i+1, prefix))
+			}
+		}
+	}
+	return problems
+}
+
+// runNotify implements the notify command which checks for new episodes
+// once, eg. from cron
+func runNotify(ctx context.Context, config Config, args []string) error {
+	fs := flag.NewFlagSet("notify", flag.ExitOnError)
+	fs.Parse(args)
+	if len(config.Webhooks) == 0 {
+		return fmt.Errorf("No webhooks configured")
+	}
+	n, err := newNotifier(config)
+	if err != nil {
+		return err
+	}
+	delivered, failed := n.check(ctx)
+	fmt.Printf("%d notifications delivered, %d failed\n", delivered, failed)
+	if failed > 0 {
+		return fmt.Errorf("Failed to deliver %d notifications", failed)
+	}
+	return nil
+}
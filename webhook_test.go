@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	podcasts, err := loadPodcasts()
+	if err != nil {
+		t.Fatalf("Failed to load podcasts\n%q", err)
+	}
+	newFakeRadioCity(t)
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	var events []episodeEvent
+	failing := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var event episodeEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Failed to parse the payload\n%q", err)
+		}
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if got, want := r.Header.Get("X-Radio-City-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+			t.Errorf("Expected the signature %s but was %s", want, got)
+		}
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	ctx := context.Background()
+	podcast := podcasts[0]
+	items, err := scrapeItems(ctx, podcast)
+	if err != nil || len(items) < 2 {
+		t.Fatalf("Failed to scrape %s\n%q", podcast.Path, err)
+	}
+	config := Config{
+		Podcasts:   []Podcast{podcast},
+		Webhooks:   []Webhook{{URL: receiver.URL, Secret: "s3cret"}},
+		WebhookLog: filepath.Join(t.TempDir(), "webhooks.json"),
+	}
+	if problems := validateWebhooks(config); len(problems) != 0 {
+		t.Errorf("Expected the webhooks to be valid but were %v", problems)
+	}
+	n, err := newNotifier(config)
+	if err != nil {
+		t.Fatalf("Failed to create notifier\n%q", err)
+	}
+	if delivered, failed := n.check(ctx); delivered != 0 || failed != 0 {
+		t.Errorf("Expected the first scrape only to be recorded but %d were delivered", delivered)
+	}
+
+	// forget the latest episode as if it was published since
+	latest := items[0].GUID.Value
+	n.log.Seen[podcast.Path] = n.log.Seen[podcast.Path][1:]
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if delivered, failed := n.check(ctx); delivered != 0 || failed != 1 {
+		t.Fatalf("Expected the delivery to fail but %d were delivered and %d failed", delivered, failed)
+	}
+	if d, _ := n.log.delivery(receiver.URL, latest); d.Attempts != webhookAttempts || d.Delivered {
+		t.Errorf("Expected the delivery to be tried %d times but was tried %d times", webhookAttempts, d.Attempts)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	n, err = newNotifier(config)
+	if err != nil {
+		t.Fatalf("Failed to reload notifier\n%q", err)
+	}
+	if delivered, failed := n.check(ctx); delivered != 1 || failed != 0 {
+		t.Fatalf("Expected the failed delivery to be retried but %d were delivered and %d failed", delivered, failed)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected one notification but got %d", len(events))
+	}
+	event := events[0]
+	if event.GUID != latest || event.Podcast != podcast.Name || event.Prefix != podcast.Path || event.Enclosure != items[0].Enclosure.URL.String() || event.Published.IsZero() {
+		t.Errorf("Expected the latest episode to be posted but was %+v", event)
+	}
+
+	// a restart after the delivery but before the scrape was recorded
+	n, err = newNotifier(config)
+	if err != nil {
+		t.Fatalf("Failed to reload notifier\n%q", err)
+	}
+	n.log.Seen[podcast.Path] = n.log.Seen[podcast.Path][1:]
+	if delivered, _ := n.check(ctx); delivered != 0 || len(events) != 1 {
+		t.Errorf("Expected a delivered episode not to be posted again")
+	}
+}
+
+func TestWebhookRetention(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	n, err := newNotifier(Config{Webhooks: []Webhook{{URL: receiver.URL}}})
+	if err != nil {
+		t.Fatalf("Failed to create notifier\n%q", err)
+	}
+	ctx := context.Background()
+	n.log.record(n.deliver(ctx, webhookDelivery{Webhook: receiver.URL, Event: episodeEvent{GUID: "ep1"}}, ""))
+	first, _ := n.log.delivery(receiver.URL, "ep1")
+
+	start := now()
+	defer func(saved func() time.Time) { now = saved }(now)
+	for _, test := range []struct {
+		after  time.Duration
+		failed int
+	}{
+		{12 * time.Hour, 1},
+		{23 * time.Hour, 1},
+		{25 * time.Hour, 0},
+	} {
+		now = func() time.Time { return start.Add(test.after) }
+		if _, failed := n.check(ctx); failed != test.failed {
+			t.Errorf("Expected %d failed retries %v after the first attempt but were %d", test.failed, test.after, failed)
+		}
+	}
+	if d, _ := n.log.delivery(receiver.URL, "ep1"); !d.FirstAt.Equal(first.FirstAt) || d.Attempts != 3*webhookAttempts {
+		t.Errorf("Expected the delivery to keep its first attempt and be tried %d times but was %+v", 3*webhookAttempts, d)
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	config := Config{
+		Podcasts: []Podcast{{Path: "/cd"}},
+		Webhooks: []Webhook{
+			{URL: "https://hooks.example.com/new", Podcasts: []string{"/cd"}},
+			{URL: "hooks.example.com"},
+			{URL: "https://hooks.example.com/other", Podcasts: []string{"/nope"}},
+		},
+	}
+	problems := validateWebhooks(config)
+	if len(problems) != 2 {
+		t.Errorf("Expected 2 problems but were %v", problems)
+	}
+}